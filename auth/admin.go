@@ -0,0 +1,320 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 500
+)
+
+// ListUsers returns up to limit accounts, oldest first, after skipping
+// offset of them, along with how many there are in all. A non-empty query
+// only matches names and emails containing it, ignoring case. Placeholders
+// of pending invitations aren't accounts yet and aren't listed.
+func (a *Authenticator) ListUsers(query string, offset, limit int) ([]*User, int, error) {
+	query = strings.ToLower(query)
+	users := []*User{}
+	total := 0
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+			u := a.deserializeUser(v)
+			if u == nil {
+				return errors.New("unlikely deserialization error")
+			}
+			if u.EncryptedPassword == "" {
+				return nil
+			}
+			if query != "" && !strings.Contains(strings.ToLower(u.UniqueName), query) &&
+				!strings.Contains(strings.ToLower(u.Email), query) {
+				return nil
+			}
+			if total >= offset && len(users) < limit {
+				users = append(users, u)
+			}
+			total++
+			return nil
+		})
+	})
+	return users, total, err
+}
+
+func ListUsers(query string, offset, limit int) ([]*User, int, error) {
+	return defaultAuth.ListUsers(query, offset, limit)
+}
+
+// DeleteUser removes an account along with its sessions and API tokens.
+func (a *Authenticator) DeleteUser(userUuid string) error {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket([]byte("users"))
+		bits := users.Get([]byte(userUuid))
+		if bits == nil {
+			return errors.New("no user")
+		}
+		u := a.deserializeUser(bits)
+		if u == nil {
+			return errors.New("unlikely deserialization error")
+		}
+		err := users.Delete([]byte(userUuid))
+		if err != nil {
+			return err
+		}
+		if u.UniqueName != "" {
+			err = tx.Bucket([]byte("user-name")).Delete([]byte(u.UniqueName))
+			if err != nil {
+				return err
+			}
+		}
+		sessions := tx.Bucket([]byte("sessions"))
+		if sessions.Bucket([]byte(userUuid)) != nil {
+			err = sessions.DeleteBucket([]byte(userUuid))
+			if err != nil {
+				return err
+			}
+		}
+		return deleteAPITokens(tx, userUuid)
+	})
+	a.authz.forget(userUuid)
+	return err
+}
+
+func DeleteUser(userUuid string) error {
+	return defaultAuth.DeleteUser(userUuid)
+}
+
+// adminUser is how the admin API shows a User.
+type adminUser struct {
+	Uuid      string                 `json:"uuid"`
+	Name      string                 `json:"name"`
+	Email     string                 `json:"email"`
+	Admin     bool                   `json:"admin"`
+	Trust     int                    `json:"trust"`
+	Active    bool                   `json:"active"`
+	LastSeen  time.Time              `json:"last_seen"`
+	Meta      map[string]interface{} `json:"meta"`
+	Groups    []string               `json:"groups"`
+	InvitedBy string                 `json:"invited_by"`
+	TOTP      bool                   `json:"totp"`
+}
+
+func newAdminUser(u *User) *adminUser {
+	return &adminUser{
+		Uuid:      u.Uuid,
+		Name:      u.UniqueName,
+		Email:     u.Email,
+		Admin:     u.Admin,
+		Trust:     u.Trust,
+		Active:    u.Active,
+		LastSeen:  u.LastSeen,
+		Meta:      u.Meta,
+		Groups:    u.Groups,
+		InvitedBy: u.InvitedBy,
+		TOTP:      u.HasTOTP(),
+	}
+}
+
+// userUpdate is the body of a PATCH, absent fields are left alone.
+type userUpdate struct {
+	Admin  *bool                  `json:"admin"`
+	Trust  *int                   `json:"trust"`
+	Active *bool                  `json:"active"`
+	Meta   map[string]interface{} `json:"meta"`
+	Groups []string               `json:"groups"`
+}
+
+// validMeta takes flat meta only, strings and numbers are what gob can
+// store in it without more types being registered.
+func validMeta(meta map[string]interface{}) error {
+	for k, v := range meta {
+		switch v.(type) {
+		case string, float64:
+		default:
+			return errors.New("meta " + strconv.Quote(k) + " must be a string or a number")
+		}
+	}
+	return nil
+}
+
+// AdminAPI manages users in JSON, for admins only. It expects to be
+// mounted with its prefix stripped, e.g.
+//
+//	http.Handle("/admin/api/", http.StripPrefix("/admin/api", auth.AdminAPI()))
+//
+// and serves
+//
+//	GET    /users?q=&offset=&limit=  ListUsers
+//	GET    /users/{uuid}
+//	PATCH  /users/{uuid}             {"admin", "trust", "active", "meta", "groups"}
+//	DELETE /users/{uuid}
+//	POST   /users/{uuid}/password    {"password"} sets it, without one
+//	                                 a NewPasswordReset token is returned
+//
+// Changing admin, trust, active or groups ends the user's sessions. Admins can't
+// delete, deactivate or demote themselves, so that there's always one.
+// Requests other than GET need the CSRFHeader.
+func (a *Authenticator) AdminAPI() http.Handler {
+	return a.Wrap(http.HandlerFunc(a.serveAdminAPI), &Rule{Admin: true, CSRF: true})
+}
+
+func AdminAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultAuth.AdminAPI().ServeHTTP(w, r)
+	})
+}
+
+func (a *Authenticator) serveAdminAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "users" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "password") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		a.serveUserList(w, r)
+		return
+	}
+	u, err := (&User{Uuid: parts[1], a: a}).Load()
+	if err != nil || u == nil || u.Uuid != parts[1] || u.EncryptedPassword == "" {
+		http.Error(w, "no user", http.StatusNotFound)
+		return
+	}
+	self := a.getSession(r).Uuid == u.Uuid
+	if len(parts) == 3 {
+		a.serveAdminPassword(w, r, u)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, newAdminUser(u))
+	case "PATCH":
+		var change userUpdate
+		err = json.NewDecoder(r.Body).Decode(&change)
+		if err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if self && ((change.Admin != nil && !*change.Admin) || (change.Active != nil && !*change.Active)) {
+			http.Error(w, "admins can't demote or deactivate themselves", http.StatusBadRequest)
+			return
+		}
+		if change.Admin != nil {
+			u.Admin = *change.Admin
+		}
+		if change.Trust != nil {
+			u.Trust = *change.Trust
+		}
+		if change.Active != nil {
+			u.Active = *change.Active
+		}
+		if change.Meta != nil {
+			err = validMeta(change.Meta)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			u.Meta = change.Meta
+		}
+		if change.Groups != nil {
+			u.Groups, err = normalizeGroups(change.Groups)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		err = u.Save()
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, newAdminUser(u))
+	case "DELETE":
+		if self {
+			http.Error(w, "admins can't delete themselves", http.StatusBadRequest)
+			return
+		}
+		err = a.DeleteUser(u.Uuid)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *Authenticator) serveUserList(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = defaultUserPageSize
+	}
+	if limit > maxUserPageSize {
+		limit = maxUserPageSize
+	}
+	users, total, err := a.ListUsers(r.FormValue("q"), offset, limit)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	shown := make([]*adminUser, len(users))
+	for i, u := range users {
+		shown[i] = newAdminUser(u)
+	}
+	writeJSON(w, map[string]interface{}{"users": shown, "total": total, "offset": offset, "limit": limit})
+}
+
+// serveAdminPassword sets a password the admin chose, subject to the
+// password policy, or hands back a reset token for the user to choose one.
+func (a *Authenticator) serveAdminPassword(w http.ResponseWriter, r *http.Request, u *User) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Password string `json:"password"`
+	}
+	if r.ContentLength != 0 && json.NewDecoder(r.Body).Decode(&body) != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	if body.Password == "" {
+		token, err := a.NewPasswordReset(u)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"reset": token})
+		return
+	}
+	err := a.CheckPassword(u.UniqueName, body.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = u.CreatePasswordHash(body.Password)
+	if err == nil {
+		err = u.Save()
+	}
+	if err == nil {
+		err = a.RevokeUserSessions(u.Uuid)
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
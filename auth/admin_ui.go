@@ -0,0 +1,391 @@
+package auth
+
+import (
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminTemplates are the admin UI's pages, self-contained so the UI works
+// wherever the binary does.
+var adminTemplates = template.Must(template.New("admin").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<meta charset="utf-8">
+<title>Admin</title>
+<style>
+body { font: 14px sans-serif; margin: 2em; max-width: 70em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border-bottom: 1px solid #ddd; padding: .3em .8em; text-align: left; }
+form.inline { display: inline; }
+.flash { background: #ffe; border: 1px solid #cc9; padding: .5em; }
+.token { font-family: monospace; word-break: break-all; }
+</style>
+<p><a href="{{.Prefix}}/">Users and invitations</a></p>
+{{if .Flash}}<p class=flash>{{.Flash}}</p>{{end}}
+{{end}}
+
+{{define "index"}}{{template "head" .}}
+<h2>Users</h2>
+<form method=GET action="{{.Prefix}}/">
+	<input type=search name=q value="{{.Query}}" placeholder="name or email">
+	<button type=submit>Search</button>
+</form>
+<table>
+<tr><th>Name</th><th>Email</th><th>Admin</th><th>Trust</th><th>Active</th><th>2FA</th></tr>
+{{range .Users}}
+<tr>
+	<td><a href="{{$.Prefix}}/users/{{.Uuid}}">{{.UniqueName}}</a></td>
+	<td>{{.Email}}</td><td>{{if .Admin}}yes{{end}}</td><td>{{.Trust}}</td>
+	<td>{{if .Active}}yes{{else}}no{{end}}</td><td>{{if .HasTOTP}}yes{{end}}</td>
+</tr>
+{{end}}
+</table>
+<p>{{.Total}} users.
+{{if .Prev}}<a href="{{.Prefix}}/?q={{.Query}}&offset={{.PrevOffset}}">previous</a>{{end}}
+{{if .Next}}<a href="{{.Prefix}}/?q={{.Query}}&offset={{.NextOffset}}">next</a>{{end}}
+</p>
+
+<h2>Pending invitations</h2>
+<table>
+<tr><th>Email</th><th>Admin</th><th>Trust</th><th>Uses</th><th>Expires</th><th></th></tr>
+{{range .Invitations}}
+<tr>
+	<td>{{.Email}}</td><td>{{if .Admin}}yes{{end}}</td><td>{{.Trust}}</td>
+	<td>{{if .MaxRedemptions}}{{len .Redemptions}}/{{.MaxRedemptions}}{{else}}1{{end}}</td>
+	<td>{{.Expires.Format "2006-01-02 15:04"}}</td>
+	<td>
+		<form class=inline method=POST action="{{$.Prefix}}/invitations/{{.Id}}/link">
+			<input type=hidden name=csrf value="{{$.CSRF}}"><button type=submit>Link</button>
+		</form>
+		<form class=inline method=POST action="{{$.Prefix}}/invitations/{{.Id}}/revoke">
+			<input type=hidden name=csrf value="{{$.CSRF}}"><button type=submit>Revoke</button>
+		</form>
+	</td>
+</tr>
+{{end}}
+</table>
+<form method=POST action="{{.Prefix}}/invitations">
+	<input type=hidden name=csrf value="{{.CSRF}}">
+	Email or note <input type=text name=email>
+	Trust <input type=number name=trust value=1 min=0>
+	<label><input type=checkbox name=admin value=true> admin</label>
+	Uses <input type=number name=max_redemptions value=0 min=0>
+	Hours <input type=number name=ttl min=0 placeholder="default">
+	<button type=submit>Invite</button>
+</form>
+
+<h2>Keys</h2>
+<p>Last rotated {{if .Rotated.IsZero}}never{{else}}{{.Rotated.Format "2006-01-02 15:04"}}{{end}}.
+Rotating drops the oldest of the keys, with it sessions and tokens older
+than all the others.</p>
+<form method=POST action="{{.Prefix}}/keys/rotate">
+	<input type=hidden name=csrf value="{{.CSRF}}"><button type=submit>Rotate keys</button>
+</form>
+{{end}}
+
+{{define "user"}}{{template "head" .}}
+<h2>{{.User.UniqueName}}</h2>
+<p>{{.User.Email}}{{if .InvitedBy}}, invited by
+<a href="{{.Prefix}}/users/{{.InvitedBy.Uuid}}">{{.InvitedBy.UniqueName}}</a>{{end}}</p>
+<form method=POST action="{{.Prefix}}/users/{{.User.Uuid}}">
+	<input type=hidden name=csrf value="{{.CSRF}}">
+	Trust <input type=number name=trust value="{{.User.Trust}}" min=0>
+	<label><input type=checkbox name=admin value=true {{if .User.Admin}}checked{{end}}> admin</label>
+	<label><input type=checkbox name=active value=true {{if .User.Active}}checked{{end}}> active</label>
+	<button type=submit>Save</button>
+</form>
+<p>Saving a change of trust, admin or active logs the user out.</p>
+
+<h3>Sessions</h3>
+<table>
+<tr><th>Session</th><th>Started</th><th>2FA</th><th></th></tr>
+{{range .Sessions}}
+<tr>
+	<td class=token>{{printf "%.8s" .Id}}</td><td>{{.Created.Format "2006-01-02 15:04"}}</td>
+	<td>{{if .SecondFactor}}yes{{end}}</td>
+	<td><form class=inline method=POST action="{{$.Prefix}}/users/{{$.User.Uuid}}/sessions/revoke">
+		<input type=hidden name=csrf value="{{$.CSRF}}"><input type=hidden name=sid value="{{.Id}}">
+		<button type=submit>End</button>
+	</form></td>
+</tr>
+{{end}}
+</table>
+<form method=POST action="{{.Prefix}}/users/{{.User.Uuid}}/sessions/revoke">
+	<input type=hidden name=csrf value="{{.CSRF}}"><button type=submit>Log out everywhere</button>
+</form>
+
+<h3>Password</h3>
+<form method=POST action="{{.Prefix}}/users/{{.User.Uuid}}/reset">
+	<input type=hidden name=csrf value="{{.CSRF}}"><button type=submit>Make a reset token</button>
+</form>
+{{end}}
+
+{{define "token"}}{{template "head" .}}
+<h2>{{.Title}}</h2>
+<p>It's only shown now, hand it over privately.</p>
+{{if .Link}}<p><a class=token href="{{.Link}}">{{.Link}}</a></p>{{end}}
+{{if .QR}}<p><img alt="QR code" src="{{.QR}}"></p>{{end}}
+<p class=token>{{.Token}}</p>
+{{end}}
+`))
+
+// adminFlashes are the messages redirects may ask for by code, anything
+// else in the flash parameter is ignored so that a link can't put words
+// in the panel's mouth.
+var adminFlashes = map[string]string{
+	"saved":         "Saved.",
+	"logged-out":    "Logged out.",
+	"revoked":       "Invitation revoked.",
+	"rotated":       "Keys rotated.",
+	"rotate-failed": "Rotating keys failed.",
+	"invite-failed": "The invitation couldn't be made, check its settings.",
+	"no-invitation": "No such pending invitation.",
+	"no-session":    "No such session.",
+	"self-demotion": "Admins can't demote or deactivate themselves.",
+	"failed":        "That didn't work, the server log has details.",
+}
+
+// adminPage is what every admin template gets.
+type adminPage struct {
+	Prefix string
+	CSRF   string
+	Flash  string
+
+	// index
+	Query       string
+	Users       []*User
+	Total       int
+	Prev, Next  bool
+	PrevOffset  int
+	NextOffset  int
+	Invitations []*Invitation
+	Rotated     time.Time
+
+	// user
+	User      *User
+	InvitedBy *User
+	Sessions  []*Session
+
+	// token
+	Title string
+	Token string
+	Link  string
+	QR    template.URL
+}
+
+// AdminUI is a small web interface over the package's Go APIs for admins:
+// users and their trust, invitations, sessions and key rotation. It's
+// mounted at prefix, e.g.
+//
+//	http.Handle("/admin/ui/", auth.AdminUI("/admin/ui"))
+func (a *Authenticator) AdminUI(prefix string) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	ui := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.serveAdminUI(w, r, prefix)
+	})
+	return a.Wrap(http.StripPrefix(prefix, ui), &Rule{Admin: true, CSRF: true})
+}
+
+func AdminUI(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultAuth.AdminUI(prefix).ServeHTTP(w, r)
+	})
+}
+
+func (a *Authenticator) serveAdminUI(w http.ResponseWriter, r *http.Request, prefix string) {
+	page := &adminPage{Prefix: prefix, CSRF: a.CSRFToken(r), Flash: adminFlashes[r.FormValue("flash")]}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	done := func(to, flash string) {
+		http.Redirect(w, r, prefix+to+"?flash="+url.QueryEscape(flash), http.StatusSeeOther)
+	}
+	failed := func(to string, err error) {
+		log.Println("admin ui:", err)
+		done(to, "failed")
+	}
+	if r.Method == "GET" {
+		switch {
+		case parts[0] == "":
+			a.adminIndex(w, r, page)
+		case len(parts) == 2 && parts[0] == "users":
+			a.adminUser(w, parts[1], page)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "invitations":
+		trust, _ := strconv.Atoi(r.FormValue("trust"))
+		uses, _ := strconv.Atoi(r.FormValue("max_redemptions"))
+		hours, _ := strconv.ParseFloat(r.FormValue("ttl"), 64)
+		inv, token, err := a.NewInvitation(InvitationOpts{
+			Email:          r.FormValue("email"),
+			Admin:          r.FormValue("admin") == "true",
+			Trust:          trust,
+			TTL:            time.Duration(hours * float64(time.Hour)),
+			Creator:        a.getSession(r).Uuid,
+			MaxRedemptions: uses,
+		})
+		if err != nil {
+			log.Println("admin ui:", err)
+			done("/", "invite-failed")
+			return
+		}
+		a.adminInvitationToken(w, page, inv, token)
+	case len(parts) == 3 && parts[0] == "invitations" && parts[2] == "link":
+		inv, err := a.Invitation(parts[1])
+		if err != nil || inv.Status != InvitationPending {
+			done("/", "no-invitation")
+			return
+		}
+		token, err := a.invitationToken(inv.Id)
+		if err != nil {
+			failed("/", err)
+			return
+		}
+		a.adminInvitationToken(w, page, inv, token)
+	case len(parts) == 3 && parts[0] == "invitations" && parts[2] == "revoke":
+		err := a.RevokeInvitation(parts[1])
+		if err != nil {
+			done("/", "no-invitation")
+			return
+		}
+		done("/", "revoked")
+	case len(parts) == 2 && parts[0] == "keys" && parts[1] == "rotate":
+		err := a.RotateActiveKeys()
+		if err != nil {
+			log.Println("rotating keys failed:", err)
+			done("/", "rotate-failed")
+			return
+		}
+		done("/", "rotated")
+	case len(parts) >= 2 && parts[0] == "users":
+		a.adminUserAction(w, r, page, parts[1], strings.Join(parts[2:], "/"), done, failed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *Authenticator) adminIndex(w http.ResponseWriter, r *http.Request, page *adminPage) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	var err error
+	page.Query = r.FormValue("q")
+	page.Users, page.Total, err = a.ListUsers(page.Query, offset, defaultUserPageSize)
+	if err == nil {
+		page.Invitations, err = a.ListPendingInvitations()
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	page.Prev, page.PrevOffset = offset > 0, offset-defaultUserPageSize
+	if page.PrevOffset < 0 {
+		page.PrevOffset = 0
+	}
+	page.Next, page.NextOffset = offset+defaultUserPageSize < page.Total, offset+defaultUserPageSize
+	page.Rotated, _ = a.lastRotationTime()
+	renderAdmin(w, "index", page)
+}
+
+func (a *Authenticator) adminUser(w http.ResponseWriter, userUuid string, page *adminPage) {
+	u, err := (&User{Uuid: userUuid, a: a}).Load()
+	if err != nil || u == nil || u.Uuid != userUuid {
+		http.Error(w, "no user", http.StatusNotFound)
+		return
+	}
+	page.User = u
+	if u.InvitedBy != "" {
+		page.InvitedBy, _ = (&User{Uuid: u.InvitedBy, a: a}).Load()
+	}
+	page.Sessions, err = a.Sessions(u.Uuid)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	renderAdmin(w, "user", page)
+}
+
+func (a *Authenticator) adminUserAction(w http.ResponseWriter, r *http.Request, page *adminPage,
+	userUuid, action string, done func(to, flash string), failed func(to string, err error)) {
+	u, err := (&User{Uuid: userUuid, a: a}).Load()
+	if err != nil || u == nil || u.Uuid != userUuid {
+		http.Error(w, "no user", http.StatusNotFound)
+		return
+	}
+	back := "/users/" + u.Uuid
+	switch action {
+	case "":
+		admin, active := r.FormValue("admin") == "true", r.FormValue("active") == "true"
+		if a.getSession(r).Uuid == u.Uuid && (!admin || !active) {
+			done(back, "self-demotion")
+			return
+		}
+		u.Trust, _ = strconv.Atoi(r.FormValue("trust"))
+		u.Admin, u.Active = admin, active
+		err = u.Save()
+		if err != nil {
+			failed(back, err)
+			return
+		}
+		done(back, "saved")
+	case "sessions/revoke":
+		if sid := r.FormValue("sid"); sid != "" {
+			err = a.RevokeSession(u.Uuid, sid)
+		} else {
+			err = a.RevokeUserSessions(u.Uuid)
+		}
+		if err != nil {
+			done(back, "no-session")
+			return
+		}
+		done(back, "logged-out")
+	case "reset":
+		token, err := a.NewPasswordReset(u)
+		if err != nil {
+			failed(back, err)
+			return
+		}
+		page.Title = "Password reset for " + u.UniqueName
+		page.Token = token
+		renderAdmin(w, "token", page)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// adminInvitationToken shows an invitation's token, and its link and QR
+// code when there's a public url to make them from.
+func (a *Authenticator) adminInvitationToken(w http.ResponseWriter, page *adminPage, inv *Invitation, token string) {
+	page.Title = "Invitation"
+	if inv.Email != "" {
+		page.Title += " for " + inv.Email
+	}
+	page.Token = token
+	if link, err := a.InvitationURL(token); err == nil {
+		page.Link = link
+		if png, err := QRCodePNG(link); err == nil {
+			page.QR = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+		}
+	}
+	renderAdmin(w, "token", page)
+}
+
+func renderAdmin(w http.ResponseWriter, name string, page *adminPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := adminTemplates.ExecuteTemplate(w, name, page)
+	if err != nil {
+		log.Println("rendering admin page failed:", err)
+	}
+}
@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/boltdb/bolt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lastUsedResolution keeps busy tokens from writing to the db on every
+// request.
+const lastUsedResolution = time.Minute
+
+// An APIToken lets scripts act as its user by sending
+// "Authorization: Bearer <token>", Wrap applies the same rules to it as to
+// the user's sessions, except that tokens never count as second factor
+// logins, and then its Scope. Only a hash of the secret part is kept, in
+// the api-tokens bucket under Id.
+type APIToken struct {
+	Id       string
+	UserUuid string
+	Name     string
+	Hash     string `json:"-"`
+	Created  time.Time
+	Expires  time.Time // zero for never
+	LastUsed time.Time
+	Scope    TokenScope
+}
+
+// A TokenScope narrows what a token can do below what its user can, empty
+// fields don't restrict anything.
+type TokenScope struct {
+	// Paths are prefixes of the request paths, as Wrap sees them, that the
+	// token may be used for, e.g. "/private-files/backups/".
+	Paths []string
+	// Methods allowed, GET allowing HEAD as well.
+	Methods []string
+	// MaxTrust caps the trust the token acts with. Tokens with a cap never
+	// act as admins, even for admin users, and once it has lowered their
+	// user's trust they don't pass TrustExactly rules or act as their user
+	// in handlers such as InviteHandler.
+	MaxTrust int
+}
+
+// permits checks a request against the path and method restrictions.
+func (s *TokenScope) permits(r *http.Request) bool {
+	if len(s.Methods) > 0 {
+		allowed := false
+		for _, m := range s.Methods {
+			if strings.EqualFold(m, r.Method) || (r.Method == "HEAD" && strings.EqualFold(m, "GET")) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(s.Paths) == 0 {
+		return true
+	}
+	// no getting out of a prefix with dot segments
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+		p += "/"
+	}
+	for _, prefix := range s.Paths {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TokenScope) restricted() bool {
+	return len(s.Paths) > 0 || len(s.Methods) > 0 || s.MaxTrust > 0
+}
+
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	bits := make([]byte, n)
+	_, err := rand.Read(bits)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bits), nil
+}
+
+func (a *Authenticator) saveAPIToken(tx *bolt.Tx, t *APIToken) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("api-tokens")).Put([]byte(t.Id), buf.Bytes())
+}
+
+func decodeAPIToken(bits []byte) (*APIToken, error) {
+	t := &APIToken{}
+	err := gob.NewDecoder(bytes.NewReader(bits)).Decode(t)
+	return t, err
+}
+
+// NewAPIToken mints a token for u, ttl zero meaning it lasts until
+// revoked. The returned string is the only copy of the secret.
+func (a *Authenticator) NewAPIToken(u *User, name string, ttl time.Duration) (*APIToken, string, error) {
+	return a.NewScopedAPIToken(u, name, ttl, TokenScope{})
+}
+
+func NewAPIToken(u *User, name string, ttl time.Duration) (*APIToken, string, error) {
+	return defaultAuth.NewAPIToken(u, name, ttl)
+}
+
+// NewScopedAPIToken mints a token limited to scope.
+func (a *Authenticator) NewScopedAPIToken(u *User, name string, ttl time.Duration, scope TokenScope) (*APIToken, string, error) {
+	if scope.MaxTrust < 0 {
+		return nil, "", errors.New("negative trust cap")
+	}
+	if u.Uuid == "" || a.dbget("users", u.Uuid) == nil {
+		return nil, "", errors.New("no user")
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	t := &APIToken{Id: id, UserUuid: u.Uuid, Name: name, Hash: hashAPISecret(secret),
+		Created: a.now(), Scope: scope}
+	if ttl > 0 {
+		t.Expires = t.Created.Add(ttl)
+	}
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		return a.saveAPIToken(tx, t)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return t, id + "." + secret, nil
+}
+
+func NewScopedAPIToken(u *User, name string, ttl time.Duration, scope TokenScope) (*APIToken, string, error) {
+	return defaultAuth.NewScopedAPIToken(u, name, ttl, scope)
+}
+
+// APITokens lists a user's tokens, oldest first, expired ones included.
+func (a *Authenticator) APITokens(userUuid string) ([]*APIToken, error) {
+	var tokens []*APIToken
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("api-tokens")).ForEach(func(k, v []byte) error {
+			t, err := decodeAPIToken(v)
+			if err != nil {
+				return err
+			}
+			if t.UserUuid == userUuid {
+				tokens = append(tokens, t)
+			}
+			return nil
+		})
+	})
+	sort.Sort(byTokenCreation(tokens))
+	return tokens, err
+}
+
+type byTokenCreation []*APIToken
+
+func (s byTokenCreation) Len() int           { return len(s) }
+func (s byTokenCreation) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+func (s byTokenCreation) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func APITokens(userUuid string) ([]*APIToken, error) {
+	return defaultAuth.APITokens(userUuid)
+}
+
+func (a *Authenticator) RevokeAPIToken(id string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("api-tokens"))
+		if b.Get([]byte(id)) == nil {
+			return errors.New("no api token")
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func RevokeAPIToken(id string) error {
+	return defaultAuth.RevokeAPIToken(id)
+}
+
+// deleteAPITokens drops every token of a user.
+func deleteAPITokens(tx *bolt.Tx, userUuid string) error {
+	b := tx.Bucket([]byte("api-tokens"))
+	var ids [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		t, err := decodeAPIToken(v)
+		if err == nil && t.UserUuid == userUuid {
+			ids = append(ids, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = b.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bearerToken is the request's Authorization: Bearer credential, if any.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// apiTokenClaims checks a bearer token and stands in claims for its user
+// as they are now, nil if the token or the user isn't good.
+func (a *Authenticator) apiTokenClaims(token string) *sessionClaims {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	bits := a.dbget("api-tokens", parts[0])
+	if bits == nil {
+		return nil
+	}
+	t, err := decodeAPIToken(bits)
+	if err != nil || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashAPISecret(parts[1]))) != 1 {
+		return nil
+	}
+	now := a.now()
+	if !t.Expires.IsZero() && !now.Before(t.Expires) {
+		return nil
+	}
+	u, err := (&User{Uuid: t.UserUuid, a: a}).Load()
+	if err != nil || u == nil || !u.Active {
+		return nil
+	}
+	if now.Sub(t.LastUsed) >= lastUsedResolution {
+		a.touchAPIToken(t.Id, now)
+	}
+	c := &sessionClaims{
+		Version:    claimsVersion,
+		UserUuid:   u.Uuid,
+		Session:    "api:" + t.Id,
+		IssuedAt:   t.Created.Unix(),
+		Admin:      u.Admin,
+		Trust:      u.Trust,
+		Generation: u.Generation,
+		Groups:     u.Groups,
+		bearer:     true,
+	}
+	if t.Scope.restricted() {
+		c.scope = &t.Scope
+	}
+	if t.Scope.MaxTrust > 0 {
+		c.capped = c.Admin || c.Trust > t.Scope.MaxTrust
+		c.Admin = false
+		if c.Trust > t.Scope.MaxTrust {
+			c.Trust = t.Scope.MaxTrust
+		}
+	}
+	return c
+}
+
+func (a *Authenticator) touchAPIToken(id string, now time.Time) {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		bits := tx.Bucket([]byte("api-tokens")).Get([]byte(id))
+		if bits == nil {
+			return nil
+		}
+		t, err := decodeAPIToken(bits)
+		if err != nil {
+			return err
+		}
+		t.LastUsed = now
+		return a.saveAPIToken(tx, t)
+	})
+	if err != nil {
+		log.Println("recording api token use failed:", err)
+	}
+}
+
+// TokenHandler lets logged in users manage their own API tokens: GET lists
+// them, POST with name and optionally ttl (in hours), path and method (both
+// repeatable) and max_trust form values mints one, see TokenScope, and
+// DELETE ?id= revokes one, all in JSON. Tokens can't be used to mint more
+// tokens.
+func (a *Authenticator) TokenHandler() http.Handler {
+	return a.Wrap(http.HandlerFunc(a.serveTokens), &Rule{Trust: 1, CSRF: true})
+}
+
+func TokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultAuth.TokenHandler().ServeHTTP(w, r)
+	})
+}
+
+func (a *Authenticator) serveTokens(w http.ResponseWriter, r *http.Request) {
+	if bearerToken(r) != "" {
+		http.Error(w, "log in to manage api tokens", http.StatusForbidden)
+		return
+	}
+	u := a.getSession(r)
+	if u.Uuid == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		tokens, err := a.APITokens(u.Uuid)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		if tokens == nil {
+			tokens = []*APIToken{}
+		}
+		writeJSON(w, tokens)
+	case "POST":
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "tokens need a name", http.StatusBadRequest)
+			return
+		}
+		hours, _ := strconv.ParseFloat(r.FormValue("ttl"), 64)
+		maxTrust, _ := strconv.Atoi(r.FormValue("max_trust"))
+		scope := TokenScope{Paths: r.Form["path"], Methods: r.Form["method"], MaxTrust: maxTrust}
+		t, token, err := a.NewScopedAPIToken(&u, name, time.Duration(hours*float64(time.Hour)), scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"api_token": t, "token": token})
+	case "DELETE":
+		bits := a.dbget("api-tokens", r.FormValue("id"))
+		if bits == nil {
+			http.Error(w, "no api token", http.StatusNotFound)
+			return
+		}
+		t, err := decodeAPIToken(bits)
+		if err != nil || t.UserUuid != u.Uuid {
+			http.Error(w, "no api token", http.StatusNotFound)
+			return
+		}
+		err = a.RevokeAPIToken(t.Id)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
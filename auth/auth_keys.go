@@ -8,11 +8,9 @@ import (
 	"io/ioutil"
 	_ "net/http"
 	"os/user"
+	"time"
 )
 
-var authKeyFile string
-var activeKeys []*fernet.Key
-
 func homeDir() (string, error) {
 	var u *user.User
 	u, err := user.Current()
@@ -25,9 +23,9 @@ func homeDir() (string, error) {
 	return u.HomeDir, nil
 }
 
-func persistKeys(keys []*fernet.Key) error {
+func (a *Authenticator) persistKeys(keys []*fernet.Key) error {
 	dump := make([]string, len(keys))
-	if len(keys) > numberOfKeys {
+	if len(keys) > a.numberOfKeys {
 		return errors.New("key count too big for setting")
 	}
 	for idx, key := range keys {
@@ -37,51 +35,58 @@ func persistKeys(keys []*fernet.Key) error {
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(authKeyFile, bytes, 0644)
-	activeKeys = keys
-	return err
+	err = ioutil.WriteFile(a.authKeyFile, bytes, 0644)
+	a.activeKeys = keys
+	if err != nil {
+		return err
+	}
+	return a.persistRotationTime(a.now())
 }
 
-func RotateActiveKeys() error {
+func (a *Authenticator) RotateActiveKeys() error {
+	a.keyLock.Lock()
+	defer a.keyLock.Unlock()
 	newKey := &fernet.Key{}
 	err := newKey.Generate()
 	if err != nil {
 		return err
 	}
-	numKeys := numberOfKeys
+	numKeys := a.numberOfKeys
 	newKeys := make([]*fernet.Key, numKeys)
 	newKeys[0] = newKey
-	if numKeys == len(activeKeys) {
-		for i, k := range activeKeys {
+	if numKeys == len(a.activeKeys) {
+		for i, k := range a.activeKeys {
 			if i == numKeys-1 {
 				continue
 			} else {
 				newKeys[i+1] = k
 			}
 		}
-		err = persistKeys(newKeys)
+		err = a.persistKeys(newKeys)
 		if err != nil {
 			return err
 		}
 	} else {
 		// Rotating keys, when the new length is different from previous,
 		// will reset all
-		k, err := createKeys(numberOfKeys)
+		k, err := createKeys(numKeys)
 		if err != nil {
 			return err
 		}
-		err = persistKeys(k)
+		err = a.persistKeys(k)
 		return err
 	}
 	return nil
 }
 
-func ResetKeys() error {
-	keys, err := createKeys(numberOfKeys)
+func (a *Authenticator) ResetKeys() error {
+	a.keyLock.Lock()
+	defer a.keyLock.Unlock()
+	keys, err := createKeys(a.numberOfKeys)
 	if err != nil {
 		return err
 	}
-	err = persistKeys(keys)
+	err = a.persistKeys(keys)
 	if err != nil {
 		return err
 	}
@@ -101,9 +106,9 @@ func createKeys(n int) ([]*fernet.Key, error) {
 	return keys, nil
 }
 
-func loadKeys() ([]*fernet.Key, error) {
+func (a *Authenticator) loadKeys() ([]*fernet.Key, error) {
 	var encodedKeys []string
-	prevKeys, err := ioutil.ReadFile(authKeyFile)
+	prevKeys, err := ioutil.ReadFile(a.authKeyFile)
 	if err != nil {
 		return nil, err
 	}
@@ -111,10 +116,10 @@ func loadKeys() ([]*fernet.Key, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(encodedKeys) != numberOfKeys {
+	if len(encodedKeys) != a.numberOfKeys {
 		return nil, errors.New("cannot load sufficient")
 	}
-	decodedKeys := make([]*fernet.Key, numberOfKeys)
+	decodedKeys := make([]*fernet.Key, a.numberOfKeys)
 	for idx, val := range encodedKeys {
 		decodedKey, err := fernet.DecodeKey(val)
 		if err != nil {
@@ -125,15 +130,35 @@ func loadKeys() ([]*fernet.Key, error) {
 	return decodedKeys, nil
 }
 
-func decode(msg string) []byte {
-	return fernet.VerifyAndDecrypt([]byte(msg), maxDuration, activeKeys)
+// decodeWithin is decode for tokens that should expire sooner than the
+// keys do.
+func (a *Authenticator) decodeWithin(msg string, ttl time.Duration) []byte {
+	a.keyLock.RLock()
+	defer a.keyLock.RUnlock()
+	return fernet.VerifyAndDecrypt([]byte(msg), ttl, a.activeKeys)
+}
+
+func (a *Authenticator) decode(msg string) []byte {
+	a.keyLock.RLock()
+	defer a.keyLock.RUnlock()
+	return fernet.VerifyAndDecrypt([]byte(msg), a.maxDuration, a.activeKeys)
 }
 
-func encode(msg interface{}) (string, error) {
+func (a *Authenticator) encode(msg interface{}) (string, error) {
 	pre, err := json.Marshal(msg)
 	if err != nil {
 		return "", err
 	}
-	post, err := fernet.EncryptAndSign(pre, activeKeys[0])
+	a.keyLock.RLock()
+	post, err := fernet.EncryptAndSign(pre, a.activeKeys[0])
+	a.keyLock.RUnlock()
 	return string(post), err
 }
+
+func RotateActiveKeys() error {
+	return defaultAuth.RotateActiveKeys()
+}
+
+func ResetKeys() error {
+	return defaultAuth.ResetKeys()
+}
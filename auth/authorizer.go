@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// A Subject is who a request comes from, as far as authorizing it goes.
+// Requests without a valid session, token or credentials get the zero
+// Subject.
+type Subject struct {
+	UserUuid     string
+	Admin        bool
+	Trust        int
+	Groups       []string
+	SecondFactor bool
+	// TrustCapped is set when an API token's MaxTrust lowered Trust or
+	// dropped Admin, Trust is then only good as a ceiling.
+	TrustCapped bool
+}
+
+// An Authorizer decides which requests Wrap lets through. Rule is the
+// usual one, AnyOf, AllOf, Not and Methods combine them, e.g. a wiki anyone
+// trusted may read but only editors may change:
+//
+//	auth.Wrap(wiki, auth.Methods{
+//		"GET": &auth.Rule{Trust: 1},
+//		"*":   &auth.Rule{Trust: 5, AnyGroup: []string{"editors"}, CSRF: true},
+//	})
+type Authorizer interface {
+	Authorize(s *Subject, r *http.Request) bool
+}
+
+// wrapOpts are the parts of a Rule that are about how Wrap handles a
+// request rather than whether it's allowed.
+type wrapOpts struct {
+	csrf      bool
+	redirect  string
+	basicAuth bool
+}
+
+// Combinators pass on the wrapOpts of the Authorizers they hold: CSRF and
+// BasicAuth if any of them asks for it, the first Redirect.
+type optsCarrier interface {
+	wrapOpts(r *http.Request) wrapOpts
+}
+
+func optsOf(az Authorizer, r *http.Request) wrapOpts {
+	if c, ok := az.(optsCarrier); ok {
+		return c.wrapOpts(r)
+	}
+	return wrapOpts{}
+}
+
+func mergeOpts(azs []Authorizer, r *http.Request) wrapOpts {
+	var o wrapOpts
+	for _, az := range azs {
+		next := optsOf(az, r)
+		o.csrf = o.csrf || next.csrf
+		o.basicAuth = o.basicAuth || next.basicAuth
+		if o.redirect == "" {
+			o.redirect = next.redirect
+		}
+	}
+	return o
+}
+
+type anyOf []Authorizer
+
+// AnyOf admits requests any of azs admits, none if it's given none.
+func AnyOf(azs ...Authorizer) Authorizer {
+	return anyOf(azs)
+}
+
+func (azs anyOf) Authorize(s *Subject, r *http.Request) bool {
+	for _, az := range azs {
+		if az.Authorize(s, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (azs anyOf) wrapOpts(r *http.Request) wrapOpts {
+	return mergeOpts(azs, r)
+}
+
+type allOf []Authorizer
+
+// AllOf admits requests all of azs admit, none if it's given none.
+func AllOf(azs ...Authorizer) Authorizer {
+	return allOf(azs)
+}
+
+func (azs allOf) Authorize(s *Subject, r *http.Request) bool {
+	for _, az := range azs {
+		if !az.Authorize(s, r) {
+			return false
+		}
+	}
+	return len(azs) > 0
+}
+
+func (azs allOf) wrapOpts(r *http.Request) wrapOpts {
+	return mergeOpts(azs, r)
+}
+
+type not struct {
+	az Authorizer
+}
+
+// Not admits requests az refuses, which includes ones from nobody and, for
+// a Rule, leaves out admins. It's meant for narrowing inside AllOf:
+//
+//	auth.AllOf(&auth.Rule{Trust: 1}, auth.Not(&auth.Rule{AnyGroup: []string{"banned"}}))
+func Not(az Authorizer) Authorizer {
+	return not{az}
+}
+
+func (n not) Authorize(s *Subject, r *http.Request) bool {
+	return !n.az.Authorize(s, r)
+}
+
+func (n not) wrapOpts(r *http.Request) wrapOpts {
+	return optsOf(n.az, r)
+}
+
+// Methods picks an Authorizer by request method, HEAD falling back on GET,
+// and methods not listed on "*". Requests with neither are refused.
+type Methods map[string]Authorizer
+
+func (m Methods) pick(r *http.Request) Authorizer {
+	if az, ok := m[r.Method]; ok {
+		return az
+	}
+	if az, ok := m["GET"]; ok && r.Method == "HEAD" {
+		return az
+	}
+	return m["*"]
+}
+
+func (m Methods) Authorize(s *Subject, r *http.Request) bool {
+	az := m.pick(r)
+	return az != nil && az.Authorize(s, r)
+}
+
+func (m Methods) wrapOpts(r *http.Request) wrapOpts {
+	az := m.pick(r)
+	if az == nil {
+		return wrapOpts{}
+	}
+	return optsOf(az, r)
+}
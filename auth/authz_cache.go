@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"sync"
+)
+
+// maxCachedUsers bounds the authorization cache, it's simply emptied when
+// it fills up.
+const maxCachedUsers = 1024
+
+// userState is what Wrap needs to know about a user beyond their session
+// claims: whether the claims are from the current security generation, and
+// which sessions are known to still be registered.
+type userState struct {
+	generation int
+	active     bool
+	sessions   map[string]bool
+}
+
+// The cache is only ever invalidated by this process, which is fine because
+// bolt keeps any other process from opening the db while we have it.
+type authzCache struct {
+	sync.Mutex
+	users map[string]*userState
+}
+
+func (c *authzCache) forget(userUuid string) {
+	c.Lock()
+	delete(c.users, userUuid)
+	c.Unlock()
+}
+
+// validSession reports whether a session is registered and was issued in
+// the user's current security generation to an active account, reading
+// bolt only on a cache miss.
+func (a *Authenticator) validSession(c *sessionClaims) bool {
+	a.authz.Lock()
+	defer a.authz.Unlock()
+	if a.authz.users == nil || len(a.authz.users) >= maxCachedUsers {
+		a.authz.users = make(map[string]*userState)
+	}
+	state, ok := a.authz.users[c.UserUuid]
+	if !ok {
+		u, err := (&User{Uuid: c.UserUuid, a: a}).Load()
+		if err != nil || u == nil {
+			return false
+		}
+		state = &userState{
+			generation: u.Generation,
+			active:     u.Active,
+			sessions:   make(map[string]bool),
+		}
+		a.authz.users[c.UserUuid] = state
+	}
+	if !state.active || state.generation != c.Generation {
+		return false
+	}
+	if !state.sessions[c.Session] {
+		if !a.sessionExists(c.UserUuid, c.Session) {
+			return false
+		}
+		state.sessions[c.Session] = true
+	}
+	return true
+}
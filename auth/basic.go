@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultBasicRealm = "restricted"
+
+// basicClaimsKey holds the claims of a request Wrap admitted with Basic
+// credentials, so that GetSession and friends see its user.
+type basicClaimsKey struct{}
+
+// basicClaims checks Basic credentials through login, so failures count
+// towards lockouts like the form's do. Users with TOTP can't use them,
+// there's no room for a code, they'll want an APIToken instead.
+func (a *Authenticator) basicClaims(r *http.Request, name, pw string) (*sessionClaims, error) {
+	err, u := a.login(name, pw, clientAddr(r.RemoteAddr))
+	if _, locked := err.(*LockoutError); locked {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("unauthorized")
+	}
+	if u.HasTOTP() {
+		return nil, errors.New("second factor required, use an api token")
+	}
+	return &sessionClaims{
+		Version:    claimsVersion,
+		UserUuid:   u.Uuid,
+		Session:    "basic",
+		IssuedAt:   time.Now().Unix(),
+		Admin:      u.Admin,
+		Trust:      u.Trust,
+		Generation: u.Generation,
+		Groups:     u.Groups,
+		basic:      true,
+	}, nil
+}
+
+func withBasicClaims(r *http.Request, c *sessionClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), basicClaimsKey{}, c))
+}
+
+func basicClaimsOf(r *http.Request) *sessionClaims {
+	c, _ := r.Context().Value(basicClaimsKey{}).(*sessionClaims)
+	return c
+}
+
+// challenge asks for Basic credentials, or to come back later after too
+// many failures.
+func (a *Authenticator) challenge(w http.ResponseWriter, err error) {
+	if lockout, ok := err.(*LockoutError); ok {
+		wait := int(lockout.Until.Sub(a.now())/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
+		http.Error(w, lockout.Error(), http.StatusTooManyRequests)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.basicRealm))
+	message := "unauthorized"
+	if err != nil {
+		message = err.Error()
+	}
+	http.Error(w, message, http.StatusUnauthorized)
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// claimsVersion is bumped whenever sessionClaims changes incompatibly,
+// cookies carrying any other version are treated as logged out.
+const claimsVersion = 1
+
+// sessionClaims is all that gets encrypted into a session cookie: enough to
+// find the user and the session, plus a snapshot of what the user was
+// allowed to do when the session was issued.
+type sessionClaims struct {
+	Version      int      `json:"v"`
+	UserUuid     string   `json:"u"`
+	Session      string   `json:"s"`
+	IssuedAt     int64    `json:"iat"`
+	Admin        bool     `json:"adm,omitempty"`
+	Trust        int      `json:"t,omitempty"`
+	Generation   int      `json:"g,omitempty"`
+	CSRF         string   `json:"csrf,omitempty"`
+	SecondFactor bool     `json:"2fa,omitempty"`
+	Groups       []string `json:"grp,omitempty"`
+
+	// bearer claims stand in for an APIToken, they're never in a cookie,
+	// scope is the token's if it's restricted and capped is set when its
+	// MaxTrust lowered Trust or dropped Admin. basic ones are for a single
+	// request Wrap admitted with Basic credentials.
+	bearer bool
+	scope  *TokenScope
+	capped bool
+	basic  bool
+}
+
+func newSessionClaims(u *User, s *Session) (*sessionClaims, error) {
+	csrf, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionClaims{
+		Version:      claimsVersion,
+		UserUuid:     u.Uuid,
+		Session:      s.Id,
+		IssuedAt:     s.Created.Unix(),
+		Admin:        u.Admin,
+		Trust:        u.Trust,
+		Generation:   u.Generation,
+		CSRF:         csrf,
+		SecondFactor: s.SecondFactor,
+		Groups:       u.Groups,
+	}, nil
+}
+
+// subject is who the claims are for, nobody for nil claims.
+func (c *sessionClaims) subject() *Subject {
+	if c == nil {
+		return &Subject{}
+	}
+	return &Subject{
+		UserUuid:     c.UserUuid,
+		Admin:        c.Admin,
+		Trust:        c.Trust,
+		Groups:       c.Groups,
+		SecondFactor: c.SecondFactor,
+		TrustCapped:  c.capped,
+	}
+}
+
+func (c *sessionClaims) Issued() time.Time {
+	return time.Unix(c.IssuedAt, 0)
+}
+
+// readClaims decrypts the request's session cookie, nil if it is missing,
+// expired or from an unknown claims version.
+func (a *Authenticator) readClaims(r *http.Request) *sessionClaims {
+	cookie, err := r.Cookie(a.sessionCookieName())
+	if err != nil {
+		return nil
+	}
+	msg := a.decode(cookie.Value)
+	if msg == nil {
+		return nil
+	}
+	c := &sessionClaims{}
+	err = json.Unmarshal(msg, c)
+	if err != nil || c.Version != claimsVersion || c.UserUuid == "" {
+		return nil
+	}
+	return c
+}
+
+// currentClaims returns the request's claims if they may be used to
+// authorize it, without reading the user db unless the cache misses. A
+// bearer token takes precedence over the cookie.
+func (a *Authenticator) currentClaims(r *http.Request) *sessionClaims {
+	if token := bearerToken(r); token != "" {
+		return a.apiTokenClaims(token)
+	}
+	if c := basicClaimsOf(r); c != nil {
+		return c
+	}
+	c := a.readClaims(r)
+	if c == nil || !a.validSession(c) {
+		return nil
+	}
+	return c
+}
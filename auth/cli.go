@@ -0,0 +1,492 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CommandUsage lists the commands Command knows.
+const CommandUsage = `commands:
+  user list [query]
+  user set-trust <user> <trust>
+  user set-admin <user> true|false
+  user disable <user>
+  user enable <user>
+  group list
+  group add <group> <user>
+  group remove <group> <user>
+  invite create [-trust n] [-admin] [-uses n] [-ttl hours] [email]
+  invite list
+  invite revoke <id>
+  keys rotate
+  keys reset
+  db check
+  db backup <file>
+users are given by name or uuid`
+
+// adminSocketName is the unix socket a running server takes commands on,
+// in the data dir. Being able to connect to it is all the authorization
+// there is, so it's only accessible to the server's own user.
+const adminSocketName = "admin.sock"
+
+// ListenAdminSocket takes commands (see Command) on a unix socket in the
+// data dir until the Authenticator is stopped. Since bolt keeps other
+// processes out of the db, that's how to manage a running server.
+func (a *Authenticator) ListenAdminSocket() error {
+	sock := path.Join(a.dataDir, adminSocketName)
+	os.Remove(sock)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(sock, 0600)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	a.background(func(stop chan struct{}) {
+		go http.Serve(l, http.HandlerFunc(a.serveCommand))
+		<-stop
+		l.Close()
+	})
+	return nil
+}
+
+func ListenAdminSocket() error {
+	return defaultAuth.ListenAdminSocket()
+}
+
+// commandResult is what the admin socket answers with.
+type commandResult struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (a *Authenticator) serveCommand(w http.ResponseWriter, r *http.Request) {
+	var args []string
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if r.Method != "POST" || err != nil {
+		http.Error(w, "expected a POST of a json array of arguments", http.StatusBadRequest)
+		return
+	}
+	var out bytes.Buffer
+	res := commandResult{}
+	err = a.RunCommand(args, &out)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Output = out.String()
+	writeJSON(w, &res)
+}
+
+// Command runs a management command given as command line arguments,
+// writing what it has to say to out. If a server is running on the data
+// dir the options point at, it runs there by way of ListenAdminSocket,
+// otherwise the db is opened directly.
+func Command(options Opts, args []string, out io.Writer) error {
+	a := &Authenticator{dataDir: options.DataDir, configPrefix: defaultConfigPrefix}
+	if options.ConfigPrefix != "" {
+		a.configPrefix = options.ConfigPrefix
+	}
+	err := a.setPathDefaults()
+	if err != nil {
+		return err
+	}
+	// paths are sent as the server will see them
+	args = append([]string(nil), args...)
+	if len(args) == 3 && args[0] == "db" && args[1] == "backup" {
+		args[2], err = filepath.Abs(args[2])
+		if err != nil {
+			return err
+		}
+	}
+	sock := path.Join(a.dataDir, adminSocketName)
+	conn, err := net.Dial("unix", sock)
+	if err == nil {
+		conn.Close()
+		return remoteCommand(sock, args, out)
+	}
+	options.ManualKeyRotation = true
+	a, err = NewAuthenticator(options)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	return a.RunCommand(args, out)
+}
+
+func remoteCommand(sock string, args []string, out io.Writer) error {
+	cli := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	res, err := cli.Post("http://admin-socket/", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+	var result commandResult
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	io.WriteString(out, result.Output)
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+// RunCommand runs a management command against this realm, see Command.
+func (a *Authenticator) RunCommand(args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errors.New(CommandUsage)
+	}
+	rest := args[2:]
+	switch args[0] + " " + args[1] {
+	case "user list":
+		return a.listUsersCommand(rest, out)
+	case "user set-trust":
+		if len(rest) != 2 {
+			return errors.New("usage: user set-trust <user> <trust>")
+		}
+		trust, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return err
+		}
+		return a.changeUser(rest[0], out, func(u *User) { u.Trust = trust })
+	case "user set-admin":
+		if len(rest) != 2 {
+			return errors.New("usage: user set-admin <user> true|false")
+		}
+		admin, err := strconv.ParseBool(rest[1])
+		if err != nil {
+			return err
+		}
+		return a.changeUser(rest[0], out, func(u *User) { u.Admin = admin })
+	case "user disable", "user enable":
+		if len(rest) != 1 {
+			return errors.New("usage: " + args[0] + " " + args[1] + " <user>")
+		}
+		active := args[1] == "enable"
+		return a.changeUser(rest[0], out, func(u *User) { u.Active = active })
+	case "group list":
+		return a.listGroupsCommand(out)
+	case "group add", "group remove":
+		if len(rest) != 2 {
+			return errors.New("usage: " + args[0] + " " + args[1] + " <group> <user>")
+		}
+		u, err := a.findUser(rest[1])
+		if err != nil {
+			return err
+		}
+		if args[1] == "add" {
+			err = a.AddToGroup(u.Uuid, rest[0])
+		} else {
+			err = a.RemoveFromGroup(u.Uuid, rest[0])
+		}
+		if err == nil {
+			u, _ = a.findUser(u.Uuid)
+			fmt.Fprintf(out, "%v: groups %v\n", u.UniqueName, strings.Join(u.Groups, ","))
+		}
+		return err
+	case "invite create":
+		return a.createInvitationCommand(rest, out)
+	case "invite list":
+		return a.listInvitationsCommand(out)
+	case "invite revoke":
+		if len(rest) != 1 {
+			return errors.New("usage: invite revoke <id>")
+		}
+		err := a.RevokeInvitation(rest[0])
+		if err == nil {
+			fmt.Fprintln(out, "revoked", rest[0])
+		}
+		return err
+	case "keys rotate":
+		err := a.RotateActiveKeys()
+		if err == nil {
+			fmt.Fprintln(out, "keys rotated")
+		}
+		return err
+	case "keys reset":
+		err := a.ResetKeys()
+		if err == nil {
+			fmt.Fprintln(out, "keys reset, all sessions and outstanding tokens are void")
+		}
+		return err
+	case "db check":
+		problems, err := a.CheckDB()
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			fmt.Fprintln(out, p)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d problems found", len(problems))
+		}
+		fmt.Fprintln(out, "ok")
+		return nil
+	case "db backup":
+		if len(rest) != 1 {
+			return errors.New("usage: db backup <file>")
+		}
+		err := a.BackupDB(rest[0])
+		if err == nil {
+			fmt.Fprintln(out, "backed up to", rest[0])
+		}
+		return err
+	}
+	return errors.New(CommandUsage)
+}
+
+// findUser takes a Uuid or a name.
+func (a *Authenticator) findUser(ref string) (*User, error) {
+	u, err := (&User{Uuid: ref, a: a}).Load()
+	if err == nil && u != nil && u.Uuid == ref {
+		return u, nil
+	}
+	u, err = (&User{UniqueName: ref, a: a}).Load()
+	if err != nil || u == nil || u.UniqueName != ref {
+		return nil, errors.New("no user " + ref)
+	}
+	return u, nil
+}
+
+func (a *Authenticator) changeUser(ref string, out io.Writer, change func(u *User)) error {
+	u, err := a.findUser(ref)
+	if err != nil {
+		return err
+	}
+	change(u)
+	err = u.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%v: admin %v, trust %v, active %v\n", u.UniqueName, u.Admin, u.Trust, u.Active)
+	return nil
+}
+
+func (a *Authenticator) listUsersCommand(args []string, out io.Writer) error {
+	if len(args) > 1 {
+		return errors.New("usage: user list [query]")
+	}
+	query := ""
+	if len(args) == 1 {
+		query = args[0]
+	}
+	users, _, err := a.ListUsers(query, 0, int(^uint(0)>>1))
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UUID\tNAME\tEMAIL\tADMIN\tTRUST\tACTIVE")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", u.Uuid, u.UniqueName, u.Email, u.Admin, u.Trust, u.Active)
+	}
+	return tw.Flush()
+}
+
+func (a *Authenticator) listGroupsCommand(out io.Writer) error {
+	groups, err := a.Groups()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tMEMBERS")
+	for _, g := range names {
+		fmt.Fprintf(tw, "%v\t%v\n", g, groups[g])
+	}
+	return tw.Flush()
+}
+
+func (a *Authenticator) createInvitationCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("invite create", flag.ContinueOnError)
+	fs.SetOutput(out)
+	trust := fs.Int("trust", 1, "trust of the invited account")
+	admin := fs.Bool("admin", false, "invite an admin")
+	uses := fs.Int("uses", 0, "make a group invitation good for this many accounts")
+	hours := fs.Float64("ttl", 0, "hours the invitation lasts, 0 for the default")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New("usage: invite create [-trust n] [-admin] [-uses n] [-ttl hours] [email]")
+	}
+	inv, token, err := a.NewInvitation(InvitationOpts{
+		Email:          fs.Arg(0),
+		Admin:          *admin,
+		Trust:          *trust,
+		TTL:            time.Duration(*hours * float64(time.Hour)),
+		MaxRedemptions: *uses,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "invitation", inv.Id, "expires", inv.Expires.Format(time.RFC3339))
+	link, err := a.InvitationURL(token)
+	if err != nil {
+		fmt.Fprintln(out, "token:", token)
+		return nil
+	}
+	fmt.Fprintln(out, link)
+	code, err := QRCodeText(link)
+	if err == nil {
+		io.WriteString(out, code)
+	}
+	return nil
+}
+
+func (a *Authenticator) listInvitationsCommand(out io.Writer) error {
+	pending, err := a.ListPendingInvitations()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tADMIN\tTRUST\tUSES\tEXPIRES")
+	for _, inv := range pending {
+		uses := "1"
+		if inv.MaxRedemptions > 0 {
+			uses = fmt.Sprintf("%v/%v", len(inv.Redemptions), inv.MaxRedemptions)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", inv.Id, inv.Email, inv.Admin, inv.Trust,
+			uses, inv.Expires.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// CheckDB looks for inconsistencies between the users, user-name,
+// sessions, api-tokens and invitations buckets, and describes any it
+// finds.
+func (a *Authenticator) CheckDB() ([]string, error) {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	err := a.db.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket([]byte("users"))
+		names := tx.Bucket([]byte("user-name"))
+		err := users.ForEach(func(k, v []byte) error {
+			u := a.deserializeUser(v)
+			if u == nil {
+				report("user %s doesn't decode", k)
+				return nil
+			}
+			if u.Uuid != string(k) {
+				report("user %s is stored under %s", u.Uuid, k)
+			}
+			if u.UniqueName == "" {
+				return nil
+			}
+			named := names.Get([]byte(u.UniqueName))
+			if named == nil {
+				report("user %s is missing from user-name as %q", k, u.UniqueName)
+			} else if n := a.deserializeUser(named); n == nil || n.Uuid != u.Uuid {
+				report("user-name %q doesn't point at user %s", u.UniqueName, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = names.ForEach(func(k, v []byte) error {
+			n := a.deserializeUser(v)
+			if n == nil {
+				report("user-name %q doesn't decode", k)
+				return nil
+			}
+			u := a.deserializeUser(users.Get([]byte(n.Uuid)))
+			if u == nil || u.UniqueName != string(k) {
+				report("user-name %q is left over, user %s isn't called that", k, n.Uuid)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte("sessions")).ForEach(func(k, v []byte) error {
+			if users.Get(k) == nil {
+				report("sessions of missing user %s", k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte("api-tokens")).ForEach(func(k, v []byte) error {
+			t, err := decodeAPIToken(v)
+			if err != nil {
+				report("api token %s doesn't decode", k)
+			} else if users.Get([]byte(t.UserUuid)) == nil {
+				report("api token %s of missing user %s", k, t.UserUuid)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("invitations")).ForEach(func(k, v []byte) error {
+			inv, err := decodeInvitation(v)
+			if err != nil {
+				report("invitation %s doesn't decode", k)
+				return nil
+			}
+			if inv.Status == InvitationPending && inv.MaxRedemptions == 0 && users.Get(k) == nil {
+				report("pending invitation %s has no placeholder user", k)
+			}
+			return nil
+		})
+	})
+	return problems, err
+}
+
+// BackupDB writes a consistent copy of the db to file, it's safe to do
+// while serving.
+func (a *Authenticator) BackupDB(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = a.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(file)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+)
+
+// hostPrefix asks browsers to only accept the cookie if it's Secure, has
+// path "/" and no domain, i.e. can't be set by a sibling subdomain.
+const hostPrefix = "__Host-"
+
+func (a *Authenticator) sessionCookieName() string {
+	if a.cookieHostPrefix {
+		return hostPrefix + a.cookieName
+	}
+	return a.cookieName
+}
+
+// newCookie applies the cookie policy from Opts. r may be nil when there's
+// no request at hand, in which case Secure is only set if configured.
+func (a *Authenticator) newCookie(value string, r *http.Request) *http.Cookie {
+	c := &http.Cookie{
+		Name:     a.sessionCookieName(),
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   a.cookieSecure || a.cookieHostPrefix || (r != nil && r.TLS != nil),
+		SameSite: a.cookieSameSite,
+	}
+	if !a.cookieHostPrefix {
+		c.Domain = a.cookieDomain
+	}
+	if a.cookieMaxAge > 0 {
+		// the cookie is worthless once its keys have rotated out anyway
+		maxAge := a.cookieMaxAge
+		if maxAge > a.maxDuration {
+			maxAge = a.maxDuration
+		}
+		c.MaxAge = int(maxAge / time.Second)
+		c.Expires = time.Now().Add(maxAge)
+	}
+	return c
+}
+
+// clearCookie overwrites the session cookie and asks the browser to drop it.
+func (a *Authenticator) clearCookie(w http.ResponseWriter, r *http.Request) {
+	c := a.newCookie("thanks_for_visiting", r)
+	c.MaxAge = -1
+	c.Expires = time.Unix(0, 0)
+	http.SetCookie(w, c)
+}
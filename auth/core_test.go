@@ -2,9 +2,13 @@ package auth
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/boltdb/bolt"
 	"github.com/fernet/fernet-go"
 	"io/ioutil"
 	"net/http"
@@ -13,7 +17,13 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -24,6 +34,23 @@ var (
 
 var testCookieName string = "testtest"
 
+var csrfInput = regexp.MustCompile(`name="csrf" value="([^"]*)"`)
+
+// loginToken loads the login page the way a browser would, leaving the
+// double submit cookie in cli's jar, and returns the form's token.
+func loginToken(t *testing.T, cli *http.Client, pageUrl string) string {
+	res, err := cli.Get(pageUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	m := csrfInput.FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("no csrf token in login page: %s", body)
+	}
+	return string(m[1])
+}
+
 func init() {
 	if *forceDeleteNonDefault || *testDataDir == "./test/data-dir" {
 		os.RemoveAll(*testDataDir)
@@ -58,16 +85,16 @@ func firstRunTest() {
 
 func TestKeyRotation(t *testing.T) {
 	initiallyActive := make(map[*fernet.Key]bool)
-	for _, val := range activeKeys {
+	for _, val := range defaultAuth.activeKeys {
 		initiallyActive[val] = true
 	}
 	err := RotateActiveKeys()
 	if err != nil {
 		t.Error(err)
 	}
-	shouldHave := len(activeKeys) - 1
+	shouldHave := len(defaultAuth.activeKeys) - 1
 	doesHave := 0
-	for _, val := range activeKeys {
+	for _, val := range defaultAuth.activeKeys {
 		_, ok := initiallyActive[val]
 		if ok {
 			doesHave++
@@ -82,7 +109,7 @@ func TestKeyRotation(t *testing.T) {
 	}
 	shouldHave = 0
 	doesHave = 0
-	for _, val := range activeKeys {
+	for _, val := range defaultAuth.activeKeys {
 		_, ok := initiallyActive[val]
 		if ok {
 			doesHave++
@@ -92,16 +119,16 @@ func TestKeyRotation(t *testing.T) {
 		t.Errorf("Expected 0 old keys to remain, got %v\n", doesHave)
 	}
 	clonedKeysPostReset := make(map[*fernet.Key]bool)
-	for _, k := range activeKeys {
+	for _, k := range defaultAuth.activeKeys {
 		clonedKeysPostReset[k] = true
 	}
-	numberOfKeys = numberOfKeys * 2
+	defaultAuth.numberOfKeys = defaultAuth.numberOfKeys * 2
 	// Key rotation on change in key number should cycle all
 	err = RotateActiveKeys()
 	if err != nil {
 		t.Errorf("error in second key rotation: %v\n", err)
 	}
-	for _, k := range activeKeys {
+	for _, k := range defaultAuth.activeKeys {
 		if clonedKeysPostReset[k] {
 			t.Errorf("Rotating after key count change failed to reset all")
 		}
@@ -110,17 +137,17 @@ func TestKeyRotation(t *testing.T) {
 
 func TestLoadKeys(t *testing.T) {
 	// this is tested indirectly in init, simply:
-	keys, err := loadKeys()
+	keys, err := defaultAuth.loadKeys()
 	if err != nil {
 		t.Error(err)
 	}
-	if len(keys) != numberOfKeys {
+	if len(keys) != defaultAuth.numberOfKeys {
 		t.Errorf("Load keys failed to retrieve expected number")
 	}
 }
 
 func TestKeyCount(t *testing.T) {
-	if len(activeKeys) < numberOfKeys {
+	if len(defaultAuth.activeKeys) < defaultAuth.numberOfKeys {
 		t.Errorf("keys failed to load")
 	}
 }
@@ -130,7 +157,7 @@ func TestUserSequence(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	u, err := acceptInvite("bmount", "s3kr3t", invitation)
+	u, err := defaultAuth.acceptInvite("bmount", "s3kr3t", invitation)
 	if err != nil {
 		t.Error(err)
 	}
@@ -138,11 +165,11 @@ func TestUserSequence(t *testing.T) {
 		t.Errorf("No user created on invite acceptance")
 	}
 
-	_, err = acceptInvite("bmount", "super-secret", invitation)
+	_, err = defaultAuth.acceptInvite("bmount", "super-secret", invitation)
 	if err == nil {
 		t.Errorf("Invite cannot be re-accpeted")
 	}
-	_, err = acceptInvite("changed-bmounts-name", "super-secret-squared", invitation)
+	_, err = defaultAuth.acceptInvite("changed-bmounts-name", "super-secret-squared", invitation)
 	if err == nil {
 		t.Errorf("Invite not independent of chosen name")
 	}
@@ -194,6 +221,7 @@ func TestUserSequence(t *testing.T) {
 	}
 	// if this isn't the login page, this test will eventually fail
 	shouldBeLoginPage, _ := ioutil.ReadAll(res.Body)
+	shouldBeLoginPage = csrfInput.ReplaceAll(shouldBeLoginPage, nil)
 	res, err = http.Get(baseUrl + "/unprotected/thing")
 	if err != nil {
 		t.Error(err)
@@ -206,10 +234,11 @@ func TestUserSequence(t *testing.T) {
 
 	// test login and serving of auth-wrapped urls to admins:
 	testCookieJar, _ := cookiejar.New(nil)
-	creds := url.Values{"username": {"bmount"}, "password": {"s3kr3t"}}
 	cli := http.Client{
 		Jar: testCookieJar,
 	}
+	creds := url.Values{"username": {"bmount"}, "password": {"s3kr3t"},
+		"csrf": {loginToken(t, &cli, baseUrl+"/any/thing")}}
 	req, err := http.NewRequest("POST", baseUrl+"/any/thing", bytes.NewBufferString(creds.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	res, err = cli.Do(req)
@@ -230,10 +259,11 @@ func TestUserSequence(t *testing.T) {
 	// invitation tokens
 	limitedUser, invitation, _ := NewUserInvitation("limited @ pretend email", false, 2)
 	semiProtectedCookieJar, _ := cookiejar.New(nil)
-	creds = url.Values{"username": {"limited"}, "password": {"p4ssw0rd"}, "invite": {invitation}}
 	cli = http.Client{
 		Jar: semiProtectedCookieJar,
 	}
+	creds = url.Values{"username": {"limited"}, "password": {"p4ssw0rd"}, "invite": {invitation},
+		"csrf": {loginToken(t, &cli, baseUrl+"/semiprotected/thing")}}
 	req, err = http.NewRequest("POST", baseUrl+"/semiprotected/thing", bytes.NewBufferString(creds.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	res, err = cli.Do(req)
@@ -264,12 +294,15 @@ func TestUserSequence(t *testing.T) {
 	res, err = cli.Get(baseUrl + "/semiprotected/thing/authenticated")
 	body, _ = ioutil.ReadAll(res.Body)
 	// this should be equal to the default view of a non-logged-in user:
-	if string(body) != string(shouldBeLoginPage) {
+	if string(csrfInput.ReplaceAll(body, nil)) != string(shouldBeLoginPage) {
 		t.Errorf("Cookie retained past overwrite request")
 	}
 
 	// test invalid login:
-	res, err = http.PostForm(baseUrl+"/any/thing", url.Values{"username": {"changed-bmounts-name"}, "password": {"super-secret-squared"}})
+	invalidJar, _ := cookiejar.New(nil)
+	cli = http.Client{Jar: invalidJar}
+	res, err = cli.PostForm(baseUrl+"/any/thing", url.Values{"username": {"changed-bmounts-name"}, "password": {"super-secret-squared"},
+		"csrf": {loginToken(t, &cli, baseUrl+"/any/thing")}})
 	if res == nil {
 		t.Error(err)
 	}
@@ -285,17 +318,17 @@ func TestUserSequence(t *testing.T) {
 
 func TestTokenCompatibility(t *testing.T) {
 	_, invitation, _ := NewUserInvitation("test-token", false, 0)
-	userIn, err := acceptInvite("test-token-user", "test-token-unencrypted-password", invitation)
+	userIn, err := defaultAuth.acceptInvite("test-token-user", "test-token-unencrypted-password", invitation)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	encoded, err := encode(userIn)
+	encoded, err := defaultAuth.encode(userIn)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	firstKey := activeKeys[0].Encode()
+	firstKey := defaultAuth.activeKeys[0].Encode()
 	pyEval := "from cryptography.fernet import Fernet; f = Fernet(b'"
 	pyEval += firstKey + "'); print f.decrypt(b'" + encoded + "')"
 	cmd := exec.Command("python", "-c", pyEval)
@@ -338,3 +371,1985 @@ func TestUserLoad(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSeparateRealms(t *testing.T) {
+	other, err := NewAuthenticator(Opts{
+		DBName:     "other.db",
+		CookieName: "other",
+		DataDir:    *testDataDir + "/other",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	u, _, err := other.FirstRunInvitation("other-admin")
+	if err != nil || u == nil {
+		t.Errorf("first run should be available in a fresh realm: %v", err)
+	}
+	if defaultAuth.dbget("users", u.Uuid) != nil {
+		t.Errorf("user leaked into the default realm")
+	}
+	if other.activeKeys[0] == defaultAuth.activeKeys[0] {
+		t.Errorf("realms share keys")
+	}
+	token, err := other.encode(u)
+	if err != nil {
+		t.Error(err)
+	}
+	if defaultAuth.decode(token) != nil {
+		t.Errorf("token from one realm accepted by another")
+	}
+}
+
+func TestScheduledKeyRotation(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/rotating", KeyRotationInterval: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// rotation is driven by hand below, not in the background
+	a.Stop()
+	clock := time.Now()
+	a.now = func() time.Time { return clock }
+	initialKey := a.activeKeys[0]
+	if wait := a.rotateIfDue(); wait <= 0 || wait > time.Hour || a.activeKeys[0] != initialKey {
+		t.Errorf("keys rotated early, next due in %v", wait)
+	}
+	clock = clock.Add(time.Hour)
+	if wait := a.rotateIfDue(); wait != time.Hour || a.activeKeys[0] == initialKey {
+		t.Errorf("keys not rotated when due, next due in %v", wait)
+	}
+	last, err := a.lastRotationTime()
+	if err != nil || !last.Equal(clock) {
+		t.Errorf("rotation time not persisted: %v %v", last, err)
+	}
+
+	// the rotation time is kept on disk, coming back long after the last
+	// rotation catches up at once
+	rotatedKey := a.activeKeys[0]
+	clock = clock.Add(5 * time.Hour)
+	if wait := a.rotateIfDue(); wait != time.Hour || a.activeKeys[0] == rotatedKey {
+		t.Errorf("overdue rotation not performed, next due in %v", wait)
+	}
+}
+
+func TestSessionRevocation(t *testing.T) {
+	_, invitation, err := NewUserInvitation("sessions", false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := defaultAuth.acceptInvite("session-user", "s3ss10ns", invitation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "SESSION ENTERED\n"
+	mux := http.NewServeMux()
+	mux.Handle("/private/", Wrap(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, msg)
+		}), &Rule{Trust: 3}))
+	mux.Handle("/logout", http.HandlerFunc(Logout))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	login := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		cli := &http.Client{Jar: jar}
+		_, err := cli.PostForm(ts.URL+"/private/", url.Values{"username": {"session-user"}, "password": {"s3ss10ns"},
+			"csrf": {loginToken(t, cli, ts.URL+"/private/")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cli
+	}
+	entered := func(cli *http.Client) bool {
+		res, err := cli.Get(ts.URL + "/private/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body) == msg
+	}
+
+	first, second := login(), login()
+	sessions, err := Sessions(u.Uuid)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v (%v)", len(sessions), err)
+	}
+	if !entered(first) || !entered(second) {
+		t.Errorf("logged in sessions were rejected")
+	}
+
+	_, err = first.Post(ts.URL+"/logout", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = Sessions(u.Uuid)
+	if len(sessions) != 1 {
+		t.Errorf("logout did not remove the session, %v remain", len(sessions))
+	}
+	if entered(first) {
+		t.Errorf("session used after logout")
+	}
+	if !entered(second) {
+		t.Errorf("logout ended an unrelated session")
+	}
+
+	// a stale cookie replayed after revocation must not work either
+	stale, _ := second.Jar.(*cookiejar.Jar)
+	cookies := stale.Cookies(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()})
+	err = RevokeSession(u.Uuid, sessions[0].Id)
+	if err != nil {
+		t.Error(err)
+	}
+	if entered(second) {
+		t.Errorf("revoked session accepted")
+	}
+	req, _ := http.NewRequest("GET", ts.URL+"/private/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) == msg {
+		t.Errorf("replayed cookie accepted after revocation")
+	}
+
+	third := login()
+	err = RevokeUserSessions(u.Uuid)
+	if err != nil {
+		t.Error(err)
+	}
+	if entered(third) {
+		t.Errorf("session survived revoking all of the user's sessions")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/session-expiry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	u, _ := a.NewUser("expiry@example.com", "pw", false, 1)
+	u.Save()
+	u.Cookie()
+	u.Cookie()
+	sessions, _ := a.Sessions(u.Uuid)
+	old := sessions[0]
+	old.Created = time.Now().Add(-a.maxDuration - time.Minute)
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(old)
+	a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("sessions")).Bucket([]byte(u.Uuid)).Put([]byte(old.Id), buf.Bytes())
+	})
+	if n, err := a.ExpireSessions(); n != 1 || err != nil {
+		t.Fatalf("expired %v sessions: %v", n, err)
+	}
+	if sessions, _ = a.Sessions(u.Uuid); len(sessions) != 1 || sessions[0].Id == old.Id {
+		t.Errorf("wrong sessions left: %+v", sessions)
+	}
+	a.RevokeSession(u.Uuid, sessions[0].Id)
+	a.ExpireSessions()
+	a.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("sessions")).Bucket([]byte(u.Uuid)) != nil {
+			t.Errorf("empty session bucket kept")
+		}
+		return nil
+	})
+}
+
+func TestSessionClaims(t *testing.T) {
+	u, err := NewUser("claims@example.com", "cl41ms", false, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.UniqueName = "claims-user"
+	u.Meta = map[string]interface{}{"private": "note"}
+	err = u.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := u.Cookie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := string(defaultAuth.decode(cookie.Value))
+	for _, secret := range []string{u.EncryptedPassword, u.Email, "private"} {
+		if bytes.Contains([]byte(plain), []byte(secret)) {
+			t.Errorf("session cookie leaks %q: %v", secret, plain)
+		}
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	resolved := defaultAuth.getSession(req)
+	if resolved.Uuid != u.Uuid || resolved.Trust != 4 || resolved.UniqueName != "claims-user" {
+		t.Errorf("session did not resolve to its user: %+v", resolved)
+	}
+
+	c := &sessionClaims{}
+	json.Unmarshal([]byte(plain), c)
+	c.Version = claimsVersion + 1
+	future, _ := defaultAuth.encode(c)
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: testCookieName, Value: future})
+	if defaultAuth.getSession(req).Uuid != "" {
+		t.Errorf("claims with an unknown version were accepted")
+	}
+}
+
+func TestPrivilegeChangeEndsSessions(t *testing.T) {
+	u, err := NewUser("generations", "g3n3r4t10n", false, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.UniqueName = "generation-user"
+	err = u.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}), &Rule{Trust: 5})
+	allowed := func(cookie *http.Cookie) bool {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Body.String() == "ok"
+	}
+	cookie, err := u.Cookie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed(cookie) {
+		t.Fatalf("fresh session rejected")
+	}
+	// renaming isn't a privilege change
+	err = u.ChangeName("generation-user-2")
+	if err != nil {
+		t.Error(err)
+	}
+	u, _ = u.Load()
+	u.Meta = map[string]interface{}{"k": "v"}
+	u.Save()
+	if !allowed(cookie) {
+		t.Errorf("unrelated change ended the session")
+	}
+
+	u.Trust = 2
+	u.Save()
+	if allowed(cookie) {
+		t.Errorf("demoted user kept access")
+	}
+	u.Trust = 5
+	u.Save()
+	if allowed(cookie) {
+		t.Errorf("old session revived by restoring trust")
+	}
+
+	cookie, _ = u.Cookie()
+	if !allowed(cookie) {
+		t.Errorf("session after restoring trust rejected")
+	}
+	u.Active = false
+	u.Save()
+	if allowed(cookie) {
+		t.Errorf("deactivated user kept access")
+	}
+	err, _ = LoginByName("generation-user-2", "g3n3r4t10n")
+	if err == nil {
+		t.Errorf("deactivated user could log in")
+	}
+}
+
+func TestCookiePolicy(t *testing.T) {
+	_, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/bad-cookies", CookieHostPrefix: true, CookieDomain: "example.com"})
+	if err == nil {
+		t.Errorf("__Host- cookie with a domain accepted")
+	}
+	a, err := NewAuthenticator(Opts{
+		DataDir:        *testDataDir + "/cookies",
+		CookieName:     "policy",
+		CookieSameSite: http.SameSiteStrictMode,
+		CookieDomain:   "example.com",
+		CookieMaxAge:   24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	u, err := a.NewUser("cookie-policy", "c00k13s", false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.UniqueName = "cookie-policy"
+	u.Save()
+
+	login := func() *http.Cookie {
+		rec := httptest.NewRecorder()
+		a.Login(rec, httptest.NewRequest("GET", "/", nil))
+		csrfCookie := rec.Result().Cookies()[0]
+		form := url.Values{"username": {"cookie-policy"}, "password": {"c00k13s"}, "csrf": {csrfCookie.Value}}
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(csrfCookie)
+		rec = httptest.NewRecorder()
+		a.Login(rec, req)
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected a session cookie, got %v", cookies)
+		}
+		return cookies[0]
+	}
+	c := login()
+	if c.Name != "policy" || c.Domain != "example.com" || c.SameSite != http.SameSiteStrictMode || !c.HttpOnly {
+		t.Errorf("cookie policy not applied: %+v", c)
+	}
+	if c.MaxAge != 24*60*60 {
+		t.Errorf("expected a persistent cookie, got max-age %v", c.MaxAge)
+	}
+	if c.Secure {
+		t.Errorf("plain http login got a Secure cookie")
+	}
+
+	a.cookieHostPrefix = true
+	tlsReq := httptest.NewRequest("GET", "https://example.com/", nil)
+	rec := httptest.NewRecorder()
+	u.setSession(rec, tlsReq, false)
+	c = rec.Result().Cookies()[0]
+	if c.Name != "__Host-policy" || !c.Secure || c.Domain != "" {
+		t.Errorf("__Host- cookie policy not applied: %+v", c)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(c)
+	a.Logout(rec, req)
+	cleared := rec.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != "__Host-policy" || cleared[0].MaxAge >= 0 {
+		t.Errorf("logout did not clear the cookie: %+v", cleared)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	u, err := NewUser("csrf", "csrfcsrf", false, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.UniqueName = "csrf-user"
+	u.Save()
+	mux := http.NewServeMux()
+	mux.Handle("/guarded/", Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "changed")
+	}), &Rule{Trust: 6, CSRF: true}))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// login form: cross-site posts and posts without the cookie fail
+	jar, _ := cookiejar.New(nil)
+	cli := &http.Client{Jar: jar}
+	token := loginToken(t, cli, ts.URL+"/guarded/")
+	creds := url.Values{"username": {"csrf-user"}, "password": {"csrfcsrf"}, "csrf": {token}}
+	res, _ := http.PostForm(ts.URL+"/guarded/", creds)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("login without the csrf cookie got %v", res.StatusCode)
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/guarded/", bytes.NewBufferString(creds.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.example.com")
+	res, _ = cli.Do(req)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-site login got %v", res.StatusCode)
+	}
+	res, _ = cli.PostForm(ts.URL+"/guarded/", creds)
+	if res.Request.URL.Path != "/" {
+		t.Fatalf("login with csrf token failed: %v", res.StatusCode)
+	}
+
+	do := func(method string, header http.Header) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+"/guarded/thing", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	if code, body := do("GET", nil); code != 200 || body != "changed" {
+		t.Errorf("safe method blocked: %v %v", code, body)
+	}
+	if code, _ := do("DELETE", nil); code != http.StatusForbidden {
+		t.Errorf("DELETE without a token got %v", code)
+	}
+	if code, _ := do("DELETE", http.Header{CSRFHeader: {"nope"}}); code != http.StatusForbidden {
+		t.Errorf("DELETE with a bad token got %v", code)
+	}
+	sessionToken := ""
+	mux.Handle("/token", Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionToken = CSRFToken(r)
+	}), &Rule{Trust: 6}))
+	cli.Get(ts.URL + "/token")
+	if sessionToken == "" {
+		t.Fatalf("no csrf token for a logged in session")
+	}
+	if code, _ := do("DELETE", http.Header{CSRFHeader: {sessionToken}}); code != 200 {
+		t.Errorf("DELETE with the session token got %v", code)
+	}
+	if code, _ := do("DELETE", http.Header{"Origin": {ts.URL}}); code != 200 {
+		t.Errorf("same-origin DELETE got %v", code)
+	}
+	if code, _ := do("DELETE", http.Header{CSRFHeader: {sessionToken}, "Origin": {"https://evil.example.com"}}); code != http.StatusForbidden {
+		t.Errorf("cross-origin DELETE got %v", code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	a, err := NewAuthenticator(Opts{
+		DataDir:          *testDataDir + "/lockout",
+		MaxLoginFailures: 5,
+		LoginBackoff:     50 * time.Millisecond,
+		LoginLockout:     time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Stop()
+	clock := time.Now()
+	a.now = func() time.Time { return clock }
+	u, _ := a.NewUser("lockout", "l0ck0ut", false, 1)
+	u.UniqueName = "lockout-user"
+	u.Save()
+
+	locked := func(err error) bool {
+		_, ok := err.(*LockoutError)
+		return ok
+	}
+	for i := 0; i < freeLoginFailures; i++ {
+		if err, _ := a.LoginByName("lockout-user", "wrong"); err == nil || locked(err) {
+			t.Fatalf("attempt %v: expected a plain failure, got %v", i, err)
+		}
+	}
+	if err, _ := a.LoginByName("lockout-user", "l0ck0ut"); !locked(err) {
+		t.Errorf("no backoff after %v failures: %v", freeLoginFailures, err)
+	}
+	clock = clock.Add(60 * time.Millisecond)
+	if err, _ := a.LoginByName("lockout-user", "wrong"); err == nil || locked(err) {
+		t.Errorf("backoff did not expire: %v", err)
+	}
+	clock = clock.Add(110 * time.Millisecond)
+	a.LoginByName("lockout-user", "wrong")
+	if err, _ := a.LoginByName("lockout-user", "l0ck0ut"); !locked(err) {
+		t.Errorf("not locked out after max failures: %v", err)
+	}
+	err = a.ClearUserLockout("lockout-user")
+	if err != nil {
+		t.Error(err)
+	}
+	if err, logged := a.LoginByName("lockout-user", "l0ck0ut"); err != nil || logged == nil {
+		t.Errorf("login after clearing the lockout failed: %v", err)
+	}
+
+	// unknown names back off the same way
+	for i := 0; i < freeLoginFailures; i++ {
+		a.LoginByName("nobody", "guess")
+	}
+	if err, _ := a.LoginByName("nobody", "guess"); !locked(err) {
+		t.Errorf("unknown user not backing off: %v", err)
+	}
+
+	// and so do addresses guessing across usernames
+	for i := 0; i < freeLoginFailures; i++ {
+		a.login(fmt.Sprintf("spray-%v", i), "guess", "192.0.2.9")
+	}
+	if err, _ := a.login("lockout-user", "l0ck0ut", "192.0.2.9"); !locked(err) {
+		t.Errorf("address not backing off: %v", err)
+	}
+	a.ClearAddressLockout("192.0.2.9")
+	if err, _ := a.login("lockout-user", "l0ck0ut", "192.0.2.9"); err != nil {
+		t.Errorf("login after clearing the address failed: %v", err)
+	}
+
+	// parallel guesses don't get past the free ones before being counted
+	a.ClearUserLockout("lockout-user")
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	guessed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err, _ := a.LoginByName("lockout-user", "wrong"); !locked(err) {
+				mu.Lock()
+				guessed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if guessed != freeLoginFailures {
+		t.Errorf("%v parallel guesses checked, not %v", guessed, freeLoginFailures)
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	u, _ := NewUser("totp", "t0tp-pw", false, 7)
+	u.UniqueName = "totp-user"
+	u.Save()
+	secret, uri, err := u.EnrollTOTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains([]byte(uri), []byte("secret="+secret)) {
+		t.Errorf("bad otpauth uri %v", uri)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := func() string { return totpCode(key, time.Now().Unix()/totpStep) }
+	if _, err = u.ConfirmTOTP("000000x"); err == nil {
+		t.Errorf("bad code confirmed enrollment")
+	}
+	recovery, err := u.ConfirmTOTP(now())
+	if err != nil || len(recovery) != recoveryCodeCount {
+		t.Fatalf("enrollment failed: %v", err)
+	}
+
+	// the secret has to survive the keys changing under it
+	err = ResetKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = u.Load()
+	if defaultAuth.decryptSecret(u.TOTPSecret) == nil {
+		t.Fatalf("totp secret lost in key reset")
+	}
+	// even when a copy loaded before the keys changed is saved after
+	stale, _ := u.Load()
+	RotateActiveKeys()
+	stale.Save()
+	ResetKeys()
+	u, _ = u.Load()
+	if defaultAuth.decryptSecret(u.TOTPSecret) == nil {
+		t.Fatalf("totp secret lost to a stale save")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/2fa/", Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "second factor")
+	}), &Rule{Trust: 7, SecondFactor: true}))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	pendingInput := regexp.MustCompile(`name="totp_pending" value="([^"]*)"`)
+
+	login := func(code string) (*http.Client, int) {
+		// every test client shares 127.0.0.1, keep it from backing off
+		ClearAddressLockout("127.0.0.1")
+		before, _ := Sessions(u.Uuid)
+		jar, _ := cookiejar.New(nil)
+		cli := &http.Client{Jar: jar}
+		token := loginToken(t, cli, ts.URL+"/2fa/")
+		res, err := cli.PostForm(ts.URL+"/2fa/", url.Values{"username": {"totp-user"}, "password": {"t0tp-pw"}, "csrf": {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		m := pendingInput.FindSubmatch(body)
+		if m == nil {
+			t.Fatalf("password step didn't ask for a code: %s", body)
+		}
+		if after, _ := Sessions(u.Uuid); len(after) != len(before) {
+			t.Errorf("session created before the second factor")
+		}
+		res, err = cli.PostForm(ts.URL+"/2fa/", url.Values{"totp_pending": {string(m[1])}, "code": {code}, "csrf": {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cli, res.StatusCode
+	}
+	entered := func(cli *http.Client) bool {
+		res, _ := cli.Get(ts.URL + "/2fa/")
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body) == "second factor"
+	}
+
+	if _, code := login("123456"); code != http.StatusUnauthorized {
+		t.Errorf("wrong code got %v", code)
+	}
+	cli, code := login(recovery[0])
+	if code != 200 || !entered(cli) {
+		t.Errorf("recovery code login failed: %v", code)
+	}
+	if _, code = login(recovery[0]); code != http.StatusUnauthorized {
+		t.Errorf("recovery code reused: %v", code)
+	}
+	RevokeUserSessions(u.Uuid)
+
+	// a password-only session doesn't satisfy the rule
+	u, _ = u.Load()
+	cookie, _ := u.Cookie()
+	req, _ := http.NewRequest("GET", ts.URL+"/2fa/", nil)
+	req.AddCookie(cookie)
+	res, _ := http.DefaultClient.Do(req)
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) == "second factor" {
+		t.Errorf("password-only session admitted by a SecondFactor rule")
+	}
+	RevokeUserSessions(u.Uuid)
+
+	// codes can't be replayed within their window
+	u, _ = u.Load()
+	u.TOTPLastStep = 0
+	u.Save()
+	c := now()
+	if cli, code = login(c); code != 200 || !entered(cli) {
+		t.Errorf("totp login failed: %v", code)
+	}
+	RevokeUserSessions(u.Uuid)
+	if _, code = login(c); code != http.StatusUnauthorized {
+		t.Errorf("totp code replayed: %v", code)
+	}
+
+	// the password alone doesn't reset the count of wrong codes
+	ClearUserLockout("totp-user")
+	login("12345")
+	login("12345")
+	var failures *loginFailures
+	defaultAuth.db.View(func(tx *bolt.Tx) error {
+		failures = defaultAuth.readFailures(tx.Bucket([]byte("login-failures")), "user:totp-user")
+		return nil
+	})
+	if failures.Count != 2 {
+		t.Errorf("%v wrong codes counted, not 2", failures.Count)
+	}
+	ClearUserLockout("totp-user")
+}
+
+func TestPasswordReset(t *testing.T) {
+	u, _ := NewUser("reset", "f0rg0tt3n", false, 1)
+	u.UniqueName = "reset-user"
+	u.Save()
+	cookie, _ := u.Cookie()
+
+	var delivered string
+	err := RequestPasswordReset("no-such-user", func(u *User, token string) error {
+		t.Errorf("reset sent for an unknown user")
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	err = RequestPasswordReset("reset-user", func(to *User, token string) error {
+		if to.Uuid != u.Uuid {
+			t.Errorf("reset sent to the wrong user")
+		}
+		delivered = token
+		return nil
+	})
+	if err != nil || delivered == "" {
+		t.Fatalf("self-service reset failed: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(ResetPassword))
+	defer ts.Close()
+	res, _ := http.Get(ts.URL + "?reset=" + url.QueryEscape(delivered))
+	body, _ := ioutil.ReadAll(res.Body)
+	if !bytes.Contains(body, []byte(delivered)) {
+		t.Errorf("reset form doesn't carry the token")
+	}
+	res, _ = http.PostForm(ts.URL, url.Values{"reset": {delivered}, "password": {"r3m3mb3r3d"}, "confirm": {"r3m3mb3r3d"}})
+	if res.StatusCode != 200 {
+		t.Errorf("reset failed: %v", res.StatusCode)
+	}
+	if err, _ := LoginByName("reset-user", "r3m3mb3r3d"); err != nil {
+		t.Errorf("new password not accepted: %v", err)
+	}
+	if err, _ := LoginByName("reset-user", "f0rg0tt3n"); err == nil {
+		t.Errorf("old password still accepted")
+	}
+	reloaded, _ := u.Load()
+	if reloaded.Uuid != u.Uuid {
+		t.Errorf("reset changed the account")
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	if defaultAuth.getSession(req).Uuid != "" {
+		t.Errorf("sessions survived a password reset")
+	}
+	res, _ = http.PostForm(ts.URL, url.Values{"reset": {delivered}, "password": {"again"}, "confirm": {"again"}})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("reset token reused: %v", res.StatusCode)
+	}
+
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/reset"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// expiry is driven by hand below, not by the sweeper
+	a.Stop()
+	clock := time.Now()
+	a.now = func() time.Time { return clock }
+	short, _ := a.NewUser("reset", "pw", false, 1)
+	short.Save()
+	token, err := a.NewPasswordReset(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock = clock.Add(a.passwordResetTTL + time.Second)
+	if _, err = a.CompletePasswordReset(token, "late"); err == nil {
+		t.Errorf("expired reset token accepted")
+	}
+	// its nonce is still recorded until expired
+	if n, err := a.ExpirePasswordResets(); err != nil || n != 1 {
+		t.Errorf("expired %v resets, %v", n, err)
+	}
+	a.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket([]byte("password-resets")).Cursor().First(); k != nil {
+			t.Errorf("reset left after expiry: %s", k)
+		}
+		return nil
+	})
+}
+
+func TestInvitationLifecycle(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/invitations"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// expiry is driven by hand below, not by the sweeper
+	a.Stop()
+	clock := time.Now()
+	a.now = func() time.Time { return clock }
+	kept, keptToken, err := a.NewInvitation(InvitationOpts{Email: "kept", Trust: 2, Creator: "someone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedToken, _ := a.NewInvitation(InvitationOpts{Email: "revoked"})
+	expiring, expiringToken, _ := a.NewInvitation(InvitationOpts{Email: "expiring", TTL: time.Minute})
+	clock = clock.Add(2 * time.Minute)
+
+	pending, err := a.ListPendingInvitations()
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("expected 2 pending invitations, got %v (%v)", len(pending), err)
+	}
+	if pending[0].Id != kept.Id || pending[0].Creator != "someone" || pending[0].Trust != 2 {
+		t.Errorf("unexpected invitation %+v", pending[0])
+	}
+
+	err = a.RevokeInvitation(revoked.Id)
+	if err != nil {
+		t.Error(err)
+	}
+	if a.RevokeInvitation(revoked.Id) == nil {
+		t.Errorf("invitation revoked twice")
+	}
+	if _, err = a.acceptInvite("revoked", "pw", revokedToken); err == nil {
+		t.Errorf("revoked invitation accepted")
+	}
+	if a.dbget("users", revoked.Id) != nil {
+		t.Errorf("revoked invitation's placeholder user remains")
+	}
+
+	if _, err = a.acceptInvite("expiring", "pw", expiringToken); err == nil {
+		t.Errorf("expired invitation accepted")
+	}
+	n, err := a.ExpireInvitations()
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 invitation to expire, got %v (%v)", n, err)
+	}
+	if inv, _ := a.Invitation(expiring.Id); inv.Status != InvitationExpired {
+		t.Errorf("invitation not marked expired: %v", inv.Status)
+	}
+	if a.dbget("users", expiring.Id) != nil {
+		t.Errorf("expired invitation's placeholder user remains")
+	}
+
+	// tokens minted before invitations were tracked carried the user
+	legacy, _ := a.encode(map[string]string{"uuid": kept.Id})
+	u, err := a.acceptInvite("kept", "pw", legacy)
+	if err != nil || u.Uuid != kept.Id || u.Trust != 2 {
+		t.Fatalf("legacy invitation token not accepted: %v", err)
+	}
+	if _, err = a.acceptInvite("kept-again", "pw", keptToken); err == nil {
+		t.Errorf("accepted invitation accepted again")
+	}
+	if inv, _ := a.Invitation(kept.Id); inv.Status != InvitationAccepted || inv.AcceptedAt.IsZero() {
+		t.Errorf("invitation not marked accepted: %+v", inv)
+	}
+	pending, _ = a.ListPendingInvitations()
+	if len(pending) != 0 {
+		t.Errorf("%v invitations still pending", len(pending))
+	}
+}
+
+func TestConcurrentAcceptance(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/concurrent-accept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	inv, token, err := a.NewInvitation(InvitationOpts{Trust: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var accepted []string
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if _, err := a.acceptInvite(name, "pw", token); err == nil {
+				mu.Lock()
+				accepted = append(accepted, name)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("racer%d", i))
+	}
+	wg.Wait()
+	if len(accepted) != 1 {
+		t.Fatalf("one invitation made %d accounts: %v", len(accepted), accepted)
+	}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("racer%d", i)
+		if taken := a.dbget("user-name", name) != nil; taken != (name == accepted[0]) {
+			t.Errorf("name %v taken: %v", name, taken)
+		}
+	}
+	u, _ := (&User{Uuid: inv.Id, a: a}).Load()
+	if u.UniqueName != accepted[0] {
+		t.Errorf("account named %v, accepted as %v", u.UniqueName, accepted[0])
+	}
+}
+
+func TestGroupInvitation(t *testing.T) {
+	inv, token, err := NewInvitation(InvitationOpts{Email: "photo club", Trust: 3, MaxRedemptions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaultAuth.dbget("users", inv.Id) != nil {
+		t.Errorf("group invitation created a placeholder user")
+	}
+	var created []string
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("club-member-%v", i)
+		u, err := defaultAuth.acceptInvite(name, "pw", token)
+		if err != nil {
+			t.Fatalf("redemption %v failed: %v", i, err)
+		}
+		if u.Trust != 3 || u.Admin || !u.Active || u.InvitationId != inv.Id {
+			t.Errorf("redeemed account has the wrong settings: %+v", u)
+		}
+		if err, _ := LoginByName(name, "pw"); err != nil {
+			t.Errorf("redeemed account can't log in: %v", err)
+		}
+		created = append(created, u.Uuid)
+		if i == 0 {
+			if _, err = defaultAuth.acceptInvite(name, "pw", token); err == nil {
+				t.Errorf("group invitation redeemed twice with the same name")
+			}
+		}
+	}
+	if _, err = defaultAuth.acceptInvite("club-member-3", "pw", token); err == nil {
+		t.Errorf("group invitation redeemed past its cap")
+	}
+	inv, _ = defaultAuth.Invitation(inv.Id)
+	if inv.Status != InvitationAccepted || len(inv.Redemptions) != 3 {
+		t.Errorf("redemptions not recorded: %+v", inv)
+	}
+	for i := range created {
+		if inv.Redemptions[i] != created[i] {
+			t.Errorf("redemption %v recorded as %v, not %v", i, inv.Redemptions[i], created[i])
+		}
+	}
+}
+
+func TestDelegatedInvitations(t *testing.T) {
+	inviter, _ := NewUser("delegator", "d3l3g4t3", false, 5)
+	inviter.UniqueName = "delegator"
+	inviter.Save()
+
+	if _, _, err := DelegateInvitation(inviter, InvitationOpts{Trust: 5}); err == nil {
+		t.Errorf("invited at the inviter's own trust")
+	}
+	if _, _, err := DelegateInvitation(inviter, InvitationOpts{Trust: 1, Admin: true}); err == nil {
+		t.Errorf("non-admin invited an admin")
+	}
+	inv, token, err := DelegateInvitation(inviter, InvitationOpts{Trust: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Creator != inviter.Uuid {
+		t.Errorf("creator not recorded")
+	}
+	u, err := defaultAuth.acceptInvite("delegated", "pw", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.InvitedBy != inviter.Uuid || u.Trust != 4 {
+		t.Errorf("inviter not recorded on the account: %+v", u)
+	}
+	if _, _, err = DelegateInvitation(inviter, InvitationOpts{Trust: 1, MaxRedemptions: 5}); err == nil {
+		t.Errorf("group invitation exceeded the quota")
+	}
+
+	// the rest of the quota through the http endpoint
+	cookie, _ := inviter.Cookie()
+	h := InviteHandler()
+	csrf := ""
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/invite", bytes.NewBufferString(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(CSRFHeader, csrf)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := post(url.Values{"trust": {"3"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("invitation without a csrf token got %v", rec.Code)
+	}
+	req := httptest.NewRequest("GET", "/invite", nil)
+	req.AddCookie(cookie)
+	csrf = CSRFToken(req)
+	for i := 0; i < 4; i++ {
+		rec := post(url.Values{"trust": {"3"}, "email": {fmt.Sprintf("friend %v", i)}})
+		if rec.Code != 200 {
+			t.Fatalf("invitation %v through the endpoint failed: %v %v", i, rec.Code, rec.Body)
+		}
+		var res struct {
+			Invitation *Invitation
+			Token      string `json:"token"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if res.Token == "" || res.Invitation.Creator != inviter.Uuid {
+			t.Errorf("unexpected response %v", rec.Body)
+		}
+	}
+	if rec := post(url.Values{"trust": {"3"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("invitation past the quota got %v", rec.Code)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var mine []*Invitation
+	json.Unmarshal(rec.Body.Bytes(), &mine)
+	if len(mine) != 4 {
+		t.Errorf("expected 4 pending invitations, got %v", len(mine))
+	}
+
+	// revoking gives quota back, and admins have none
+	RevokeInvitation(mine[0].Id)
+	if rec := post(url.Values{"trust": {"3"}}); rec.Code != 200 {
+		t.Errorf("revoked invitation still counted against the quota: %v", rec.Code)
+	}
+	admin, _ := NewUser("delegating admin", "pw", true, 0)
+	admin.Save()
+	for i := 0; i < defaultInviteQuota+1; i++ {
+		if _, _, err := DelegateInvitation(admin, InvitationOpts{Admin: true, Trust: 1e9}); err != nil {
+			t.Fatalf("admin invitation failed: %v", err)
+		}
+	}
+}
+
+func TestInvitationTree(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/tree"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	invite := func(inviter *User, name string) *User {
+		_, token, err := a.NewInvitation(InvitationOpts{Trust: 3, Creator: inviter.Uuid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := a.acceptInvite(name, "pw", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	root, _ := a.NewUser("root", "pw", true, 0)
+	root.UniqueName = "root"
+	root.Save()
+	mid := invite(root, "mid")
+	leaf := invite(mid, "leaf")
+	sibling := invite(root, "sibling")
+	a.NewInvitation(InvitationOpts{Creator: leaf.Uuid})
+
+	tree, err := a.InvitationTree(root.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Size() != 4 || len(tree.Invited) != 2 || tree.Invited[0].User.Uuid != mid.Uuid ||
+		tree.Invited[0].Invited[0].User.Uuid != leaf.Uuid {
+		t.Errorf("unexpected tree %+v", tree)
+	}
+
+	cookie, _ := leaf.Cookie()
+	var served bool
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }), &Rule{Trust: 1})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !served {
+		t.Fatalf("leaf session refused before revocation")
+	}
+
+	revoked, err := a.RevokeSubtree(mid.Uuid, false)
+	if err != nil || len(revoked) != 1 {
+		t.Errorf("expected only mid revoked, got %v (%v)", revoked, err)
+	}
+	revoked, err = a.RevokeSubtree(mid.Uuid, true)
+	if err != nil || len(revoked) != 1 || revoked[0] != leaf.Uuid {
+		t.Errorf("expected leaf revoked by the cascade, got %v (%v)", revoked, err)
+	}
+	served = false
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if served {
+		t.Errorf("revoked user's session still works")
+	}
+	if s, _ := a.Sessions(leaf.Uuid); len(s) != 0 {
+		t.Errorf("revoked user's sessions remain")
+	}
+	if pending, _ := a.ListPendingInvitations(); len(pending) != 0 {
+		t.Errorf("revoked user's invitations still pending")
+	}
+	for _, u := range []*User{root, sibling} {
+		u, _ = u.Load()
+		if !u.Active {
+			t.Errorf("%v deactivated outside the subtree", u.UniqueName)
+		}
+	}
+	if _, err = a.RevokeSubtree("nobody", true); err == nil {
+		t.Errorf("revoked a missing user")
+	}
+}
+
+func TestInvitationURL(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/invitation-url", PublicURL: "https://example.com/admin/?tab=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	inv, token, err := a.NewInvitation(InvitationOpts{Trust: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := a.InvitationURL(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host != "example.com" || parsed.Path != "/admin/" ||
+		parsed.Query().Get("tab") != "1" || parsed.Query().Get("invite") != token {
+		t.Errorf("unexpected invitation url %v", link)
+	}
+
+	text, err := QRCodeText(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) < 10 || utf8.RuneCountInString(lines[0]) != utf8.RuneCountInString(lines[len(lines)-1]) {
+		t.Errorf("terminal qr code isn't square-ish:\n%v", text)
+	}
+
+	h := a.InvitationQRHandler()
+	get := func(path string, admin bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if admin {
+			u, _ := a.NewUser("qr admin", "pw", true, 0)
+			u.Save()
+			cookie, _ := u.Cookie()
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get("/?id="+inv.Id, false); rec.Header().Get("Content-Type") == "image/png" {
+		t.Errorf("qr code shown without logging in")
+	}
+	rec := get("/?id="+inv.Id, true)
+	if rec.Code != 200 || !bytes.HasPrefix(rec.Body.Bytes(), []byte("\x89PNG")) {
+		t.Errorf("expected a png, got %v %v", rec.Code, rec.Header())
+	}
+	rec = get("/?format=text&id="+inv.Id, true)
+	if rec.Code != 200 || !strings.HasPrefix(rec.Body.String(), "https://example.com/admin/?") {
+		t.Errorf("expected the link and a text qr code, got %v %v", rec.Code, rec.Body)
+	}
+	a.RevokeInvitation(inv.Id)
+	if rec = get("/?id="+inv.Id, true); rec.Code != http.StatusGone {
+		t.Errorf("qr code of a revoked invitation got %v", rec.Code)
+	}
+	if rec = get("/?id=nothing", true); rec.Code != http.StatusNotFound {
+		t.Errorf("qr code of a missing invitation got %v", rec.Code)
+	}
+}
+
+func TestPasswordHashing(t *testing.T) {
+	dir := *testDataDir + "/hashing"
+	open := func(o Opts) *Authenticator {
+		o.DataDir = dir
+		a, err := NewAuthenticator(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	stored := func(a *Authenticator) string {
+		u, err := (&User{UniqueName: "hashed", a: a}).Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.EncryptedPassword
+	}
+
+	a := open(Opts{PasswordHasher: &BcryptHasher{Cost: 4}})
+	u, _ := a.NewUser("", "pw", false, 1)
+	u.UniqueName = "hashed"
+	u.Save()
+	if !strings.HasPrefix(stored(a), "$2a$04$") {
+		t.Errorf("expected a cost 4 bcrypt hash, got %v", stored(a))
+	}
+	a.Close()
+
+	argon := &Argon2Hasher{Time: 1, Memory: 1024, Threads: 1}
+	a = open(Opts{PasswordHasher: argon, PasswordPepper: "pepper"})
+	if err, _ := a.LoginByName("hashed", "pw"); err != nil {
+		t.Fatalf("bcrypt password stopped working: %v", err)
+	}
+	if !strings.HasPrefix(stored(a), "$peppered$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("password not rehashed with argon2id and the pepper: %v", stored(a))
+	}
+	if err, _ := a.LoginByName("hashed", "wrong"); err == nil {
+		t.Errorf("wrong password accepted")
+	}
+	before := stored(a)
+	if err, _ := a.LoginByName("hashed", "pw"); err != nil || stored(a) != before {
+		t.Errorf("up to date hash changed or stopped working: %v", err)
+	}
+	a.Close()
+
+	a = open(Opts{PasswordHasher: &Argon2Hasher{Time: 2, Memory: 2048, Threads: 1}, PasswordPepper: "pepper"})
+	if err, _ := a.LoginByName("hashed", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored(a), "$peppered$argon2id$v=19$m=2048,t=2,p=1$") {
+		t.Errorf("password not rehashed with stronger parameters: %v", stored(a))
+	}
+	a.Close()
+
+	a = open(Opts{PasswordHasher: argon})
+	if err, _ := a.LoginByName("hashed", "pw"); err == nil {
+		t.Errorf("peppered password accepted without the pepper")
+	}
+	a.ClearUserLockout("hashed")
+	a.Close()
+
+	a = open(Opts{PasswordHasher: &BcryptHasher{Cost: 5}, PasswordPepper: "pepper"})
+	defer a.Close()
+	if err, _ := a.LoginByName("hashed", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored(a), "$peppered$2a$05$") {
+		t.Errorf("password not rehashed back to bcrypt: %v", stored(a))
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := *testDataDir + "/policy"
+	os.MkdirAll(dir, 0755)
+	// a sorted list with counts and windows line endings, like the
+	// downloadable pwned passwords
+	var hashes []string
+	for i := 0; i < 500; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("filler %v", i)))
+		hashes = append(hashes, strings.ToUpper(hex.EncodeToString(sum[:]))+":3")
+	}
+	sum := sha1.Sum([]byte("correcthorse"))
+	hashes = append(hashes, strings.ToUpper(hex.EncodeToString(sum[:]))+":1")
+	sort.Strings(hashes)
+	list := dir + "/breached.txt"
+	ioutil.WriteFile(list, []byte(strings.Join(hashes, "\r\n")), 0644)
+
+	a, err := NewAuthenticator(Opts{DataDir: dir, MinPasswordLength: 8,
+		DisallowNameInPassword: true, BreachedPasswords: list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for _, pw := range []string{"", "short", "xx-Alice-xx", "correcthorse", "filler 0", "filler 499", strings.Repeat("x", 73)} {
+		if _, ok := a.CheckPassword("alice", pw).(*PasswordError); !ok {
+			t.Errorf("%q should have been refused", pw)
+		}
+	}
+	for _, pw := range []string{"battery staple", "filler 500", "CORRECTHORSE"} {
+		if err := a.CheckPassword("alice", pw); err != nil {
+			t.Errorf("%q refused: %v", pw, err)
+		}
+	}
+
+	// accepting an invitation through the login form
+	inv, token, _ := a.NewInvitation(InvitationOpts{Trust: 1})
+	ts := httptest.NewServer(a.Wrap(http.NotFoundHandler(), &Rule{Trust: 1}))
+	defer ts.Close()
+	jar, _ := cookiejar.New(nil)
+	cli := &http.Client{Jar: jar}
+	page := ts.URL + "/?" + url.Values{"invite": {token}}.Encode()
+	res, err := cli.PostForm(page, url.Values{"username": {"alice"}, "password": {"alice1234"},
+		"csrf": {loginToken(t, cli, page)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "must not contain your user name") ||
+		!csrfInput.Match(body) {
+		t.Errorf("refused password didn't show the login form with a reason: %v %s", res.StatusCode, body)
+	}
+	if inv, _ = a.Invitation(inv.Id); inv.Status != InvitationPending {
+		t.Errorf("refused password used up the invitation")
+	}
+	u, err := a.acceptInvite("alice", "battery staple", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resets and changes
+	reset, _ := a.NewPasswordReset(u)
+	if _, err = a.CompletePasswordReset(reset, "correcthorse"); err == nil {
+		t.Errorf("reset to a breached password")
+	}
+	if _, err = a.CompletePasswordReset(reset, "new staple"); err != nil {
+		t.Errorf("refused password used up the reset token: %v", err)
+	}
+	if err = u.ChangePassword("battery staple", "newer staple"); err == nil {
+		t.Errorf("password changed with the wrong current password")
+	}
+	if err = u.ChangePassword("new staple", "short"); err == nil {
+		t.Errorf("password changed to a short one")
+	}
+	if err = u.ChangePassword("new staple", "newer staple"); err != nil {
+		t.Error(err)
+	}
+	if err, _ = a.LoginByName("alice", "newer staple"); err != nil {
+		t.Errorf("changed password doesn't work: %v", err)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/admin-api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	newUser := func(name string, admin bool) *User {
+		u, _ := a.NewUser(name+"@example.com", "pw", admin, 1)
+		u.UniqueName = name
+		u.Save()
+		return u
+	}
+	admin := newUser("boss", true)
+	var staff []*User
+	for i := 0; i < 5; i++ {
+		staff = append(staff, newUser(fmt.Sprintf("staff%v", i), false))
+	}
+	newUser("outsider", false)
+	a.NewInvitation(InvitationOpts{Email: "staff-to-be"})
+
+	h := http.StripPrefix("/api", a.AdminAPI())
+	adminCookie, _ := admin.Cookie()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(adminCookie)
+	csrf := a.CSRFToken(req)
+	call := func(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api"+path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		req.Header.Set(CSRFHeader, csrf)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	var list struct {
+		Users []*adminUser
+		Total int
+	}
+	rec := call("GET", "/users?q=STAFF&offset=1&limit=2", "", adminCookie)
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if rec.Code != 200 || list.Total != 5 || len(list.Users) != 2 || list.Users[0].Uuid != staff[1].Uuid {
+		t.Errorf("unexpected user list %v %s", rec.Code, rec.Body)
+	}
+	rec = call("GET", "/users", "", adminCookie)
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if list.Total != 7 {
+		t.Errorf("expected 7 users without the invitation placeholder, got %v", list.Total)
+	}
+
+	staffCookie, _ := staff[0].Cookie()
+	if rec = call("GET", "/users", "", staffCookie); strings.Contains(rec.Body.String(), staff[1].Uuid) {
+		t.Errorf("non-admin listed users")
+	}
+	var shown adminUser
+	rec = call("GET", "/users/"+staff[0].Uuid, "", adminCookie)
+	json.Unmarshal(rec.Body.Bytes(), &shown)
+	if shown.Name != "staff0" || shown.Email != "staff0@example.com" || !shown.Active {
+		t.Errorf("unexpected user %s", rec.Body)
+	}
+
+	rec = call("PATCH", "/users/"+staff[0].Uuid, `{"trust": 7, "meta": {"team": "ops"}}`, adminCookie)
+	json.Unmarshal(rec.Body.Bytes(), &shown)
+	if rec.Code != 200 || shown.Trust != 7 || shown.Meta["team"] != "ops" || !shown.Active {
+		t.Errorf("update failed: %v %s", rec.Code, rec.Body)
+	}
+	staffReq := httptest.NewRequest("GET", "/", nil)
+	staffReq.AddCookie(staffCookie)
+	if a.currentClaims(staffReq) != nil {
+		t.Errorf("session survived a change of trust")
+	}
+	if rec = call("PATCH", "/users/"+staff[0].Uuid, `{"meta": {"team": {"name": "ops"}}}`, adminCookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("nested meta got %v", rec.Code)
+	}
+	rec = call("PATCH", "/users/"+staff[0].Uuid, `{"groups": ["ops", "dev", "ops"]}`, adminCookie)
+	json.Unmarshal(rec.Body.Bytes(), &shown)
+	if rec.Code != 200 || strings.Join(shown.Groups, ",") != "dev,ops" {
+		t.Errorf("groups not normalized: %v %s", rec.Code, rec.Body)
+	}
+	if rec = call("PATCH", "/users/"+admin.Uuid, `{"admin": false}`, adminCookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("admin demoted themselves: %v", rec.Code)
+	}
+	csrf = ""
+	if rec = call("DELETE", "/users/"+staff[1].Uuid, "", adminCookie); rec.Code != http.StatusForbidden {
+		t.Errorf("delete without a csrf token got %v", rec.Code)
+	}
+	csrf = a.CSRFToken(req)
+	if rec = call("DELETE", "/users/"+staff[1].Uuid, "", adminCookie); rec.Code != http.StatusNoContent {
+		t.Errorf("delete failed: %v", rec.Code)
+	}
+	if u, _ := (&User{UniqueName: "staff1", a: a}).Load(); u != nil {
+		t.Errorf("deleted user still found by name")
+	}
+	if rec = call("GET", "/users/"+staff[1].Uuid, "", adminCookie); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted user still found: %v", rec.Code)
+	}
+
+	if rec = call("POST", "/users/"+staff[2].Uuid+"/password", `{"password": "chosen by admin"}`, adminCookie); rec.Code != http.StatusNoContent {
+		t.Errorf("setting a password failed: %v %s", rec.Code, rec.Body)
+	}
+	if err, _ := a.LoginByName("staff2", "chosen by admin"); err != nil {
+		t.Errorf("password set by an admin doesn't work: %v", err)
+	}
+	var reset map[string]string
+	rec = call("POST", "/users/"+staff[3].Uuid+"/password", "", adminCookie)
+	json.Unmarshal(rec.Body.Bytes(), &reset)
+	if _, err = a.CompletePasswordReset(reset["reset"], "chosen by staff"); err != nil {
+		t.Errorf("reset token from the api doesn't work: %v %s", err, rec.Body)
+	}
+}
+
+func TestAdminUI(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/admin-ui", PublicURL: "https://example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	admin, _ := a.NewUser("boss@example.com", "pw", true, 0)
+	admin.UniqueName = "boss"
+	admin.Save()
+	member, _ := a.NewUser("member@example.com", "pw", false, 2)
+	member.UniqueName = "<member>"
+	member.Save()
+	memberCookie, _ := member.Cookie()
+
+	h := a.AdminUI("/admin/ui/")
+	adminCookie, _ := admin.Cookie()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(adminCookie)
+	csrf := a.CSRFToken(req)
+	get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/ui"+path, nil)
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		form.Set("csrf", csrf)
+		req := httptest.NewRequest("POST", "/admin/ui"+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(adminCookie)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/", memberCookie); strings.Contains(rec.Body.String(), "Pending invitations") {
+		t.Errorf("admin ui shown to a non-admin")
+	}
+	rec := get("/", adminCookie)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "&lt;member&gt;") ||
+		!strings.Contains(rec.Body.String(), `value="`+csrf+`"`) {
+		t.Errorf("unexpected index %v %s", rec.Code, rec.Body)
+	}
+
+	rec = post("/invitations", url.Values{"email": {"newcomer"}, "trust": {"1"}})
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "https://example.com/?invite=") ||
+		!strings.Contains(rec.Body.String(), "data:image/png;base64,") {
+		t.Errorf("invitation page lacks a link or qr code: %v %s", rec.Code, rec.Body)
+	}
+	pending, _ := a.ListPendingInvitations()
+	if len(pending) != 1 || pending[0].Creator != admin.Uuid {
+		t.Fatalf("invitation not made by the admin: %+v", pending)
+	}
+	if rec = post("/invitations/"+pending[0].Id+"/revoke", url.Values{}); rec.Code != http.StatusSeeOther {
+		t.Errorf("revoking got %v", rec.Code)
+	}
+	if pending, _ = a.ListPendingInvitations(); len(pending) != 0 {
+		t.Errorf("invitation not revoked")
+	}
+	if rec = get("/?flash=revoked", adminCookie); !strings.Contains(rec.Body.String(), "Invitation revoked.") {
+		t.Errorf("flash message not shown")
+	}
+	if rec = get("/?flash=Re-enter+your+password", adminCookie); strings.Contains(rec.Body.String(), "Re-enter") {
+		t.Errorf("arbitrary flash text shown")
+	}
+
+	if rec = get("/users/"+member.Uuid, adminCookie); !strings.Contains(rec.Body.String(), "member@example.com") {
+		t.Errorf("unexpected user page %s", rec.Body)
+	}
+	sessions, _ := a.Sessions(member.Uuid)
+	post("/users/"+member.Uuid+"/sessions/revoke", url.Values{"sid": {sessions[0].Id}})
+	if sessions, _ = a.Sessions(member.Uuid); len(sessions) != 0 {
+		t.Errorf("session not ended")
+	}
+	post("/users/"+member.Uuid, url.Values{"trust": {"4"}, "active": {"true"}})
+	if u, _ := member.Load(); u.Trust != 4 || u.Admin || !u.Active {
+		t.Errorf("user not updated: %+v", u)
+	}
+	post("/users/"+admin.Uuid, url.Values{"trust": {"4"}, "active": {"true"}})
+	if u, _ := admin.Load(); !u.Admin {
+		t.Errorf("admin demoted themselves")
+	}
+	if rec = post("/users/"+member.Uuid+"/reset", url.Values{}); !strings.Contains(rec.Body.String(), "Password reset for") {
+		t.Errorf("no reset token shown: %s", rec.Body)
+	}
+
+	before, _ := a.lastRotationTime()
+	post("/keys/rotate", url.Values{})
+	if after, _ := a.lastRotationTime(); !after.After(before) {
+		t.Errorf("keys not rotated")
+	}
+	req = httptest.NewRequest("POST", "/admin/ui/keys/rotate", nil)
+	req.AddCookie(adminCookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("rotation without a csrf token got %v", rec.Code)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dir := *testDataDir + "/commands"
+	a, err := NewAuthenticator(Opts{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := a.NewUser("cli@example.com", "pw", false, 1)
+	u.UniqueName = "cli"
+	u.Save()
+	err = a.ListenAdminSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := Command(Opts{DataDir: dir}, args, &out)
+		return out.String(), err
+	}
+
+	// over the socket while the realm has the db open
+	out, err := run("user", "set-trust", "cli", "3")
+	if err != nil || !strings.Contains(out, "trust 3") {
+		t.Errorf("set-trust: %v %v", out, err)
+	}
+	if u, _ = u.Load(); u.Trust != 3 {
+		t.Errorf("trust not changed by the command")
+	}
+	if _, err = run("user", "disable", u.Uuid); err != nil {
+		t.Error(err)
+	}
+	out, err = run("user", "list")
+	if err != nil || !strings.Contains(out, "cli@example.com") || !strings.Contains(out, "false") {
+		t.Errorf("user list: %v %v", out, err)
+	}
+	if _, err = run("user", "set-trust", "nobody", "3"); err == nil || !strings.Contains(err.Error(), "no user") {
+		t.Errorf("expected an error for a missing user, got %v", err)
+	}
+	out, err = run("invite", "create", "-trust", "2", "-uses", "3", "team")
+	if err != nil || !strings.Contains(out, "token: ") {
+		t.Errorf("invite create: %v %v", out, err)
+	}
+	pending, _ := a.ListPendingInvitations()
+	if len(pending) != 1 || pending[0].Trust != 2 || pending[0].MaxRedemptions != 3 || pending[0].Email != "team" {
+		t.Errorf("unexpected invitations %+v", pending)
+	}
+	out, _ = run("invite", "list")
+	if !strings.Contains(out, pending[0].Id) || !strings.Contains(out, "0/3") {
+		t.Errorf("invite list: %v", out)
+	}
+	before, _ := a.lastRotationTime()
+	if _, err = run("keys", "rotate"); err != nil {
+		t.Error(err)
+	}
+	if after, _ := a.lastRotationTime(); !after.After(before) {
+		t.Errorf("keys not rotated by the server")
+	}
+	if out, err = run("db", "check"); err != nil || out != "ok\n" {
+		t.Errorf("db check: %v %v", out, err)
+	}
+	backup := dir + "/backup.db"
+	os.Remove(backup)
+	if _, err = run("db", "backup", backup); err != nil {
+		t.Error(err)
+	}
+	if _, err = run("no", "such", "command"); err == nil || !strings.Contains(err.Error(), "commands:") {
+		t.Errorf("expected usage, got %v", err)
+	}
+	a.Close()
+
+	// directly on the backup once the server is gone
+	b, err := NewAuthenticator(Opts{DataDir: dir, DBName: "backup.db", ManualKeyRotation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.dbput("user-name", "ghost", b.dbget("users", u.Uuid))
+	b.Close()
+	out, err = run("user", "list")
+	if err != nil || !strings.Contains(out, "cli@example.com") {
+		t.Errorf("local user list: %v %v", out, err)
+	}
+	var problems bytes.Buffer
+	err = Command(Opts{DataDir: dir, DBName: "backup.db"}, []string{"db", "check"}, &problems)
+	if err == nil || !strings.Contains(problems.String(), `user-name "ghost" is left over`) {
+		t.Errorf("db check missed a stray name: %v %v", problems.String(), err)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/api-tokens"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Stop()
+	clock := time.Now()
+	a.now = func() time.Time { return clock }
+	u, _ := a.NewUser("scripter@example.com", "pw", false, 3)
+	u.UniqueName = "scripter"
+	u.Save()
+
+	// minted through the handler with a session
+	cookie, _ := u.Cookie()
+	h := a.TokenHandler()
+	req := httptest.NewRequest("POST", "/tokens", strings.NewReader("name=cron"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	req.Header.Set(CSRFHeader, a.CSRFToken(req))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var minted struct {
+		APIToken *APIToken `json:"api_token"`
+		Token    string
+	}
+	json.Unmarshal(rec.Body.Bytes(), &minted)
+	if rec.Code != 200 || minted.Token == "" || minted.APIToken.Name != "cron" {
+		t.Fatalf("minting failed: %v %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), minted.APIToken.Id+"\",\"Hash") {
+		t.Errorf("token hash exposed")
+	}
+
+	served := 0
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ })
+	call := func(method, token string, rule *Rule) bool {
+		before := served
+		req := httptest.NewRequest(method, "/couchdb/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		a.Wrap(ok, rule).ServeHTTP(httptest.NewRecorder(), req)
+		return served > before
+	}
+	if !call("GET", minted.Token, &Rule{Trust: 3}) {
+		t.Errorf("token refused")
+	}
+	if !call("PUT", minted.Token, &Rule{Trust: 3, CSRF: true}) {
+		t.Errorf("token needed a csrf token")
+	}
+	if call("GET", minted.Token, &Rule{Trust: 4}) || call("GET", minted.Token, &Rule{Admin: true}) {
+		t.Errorf("token exceeded its user's rights")
+	}
+	if call("GET", minted.Token, &Rule{Trust: 3, SecondFactor: true}) {
+		t.Errorf("token passed for a second factor login")
+	}
+	if call("GET", minted.APIToken.Id+".wrong", &Rule{Trust: 1}) || call("GET", "garbage", &Rule{Trust: 1}) {
+		t.Errorf("bad token accepted")
+	}
+	tokens, _ := a.APITokens(u.Uuid)
+	if len(tokens) != 1 || tokens[0].LastUsed.IsZero() {
+		t.Errorf("last use not recorded: %+v", tokens)
+	}
+
+	// tokens follow their user
+	u.Trust = 2
+	u.Save()
+	if call("GET", minted.Token, &Rule{Trust: 3}) {
+		t.Errorf("token kept its user's old trust")
+	}
+	u.Trust = 3
+	u.Save()
+
+	// and can't mint more
+	req = httptest.NewRequest("POST", "/tokens", strings.NewReader("name=more"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+minted.Token)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("token minted a token: %v", rec.Code)
+	}
+
+	_, short, _ := a.NewAPIToken(u, "short", time.Minute)
+	clock = clock.Add(2 * time.Minute)
+	if call("GET", short, &Rule{Trust: 1}) {
+		t.Errorf("expired token accepted")
+	}
+
+	// the change of trust ended the session
+	cookie, _ = u.Cookie()
+	req = httptest.NewRequest("DELETE", "/tokens?id="+minted.APIToken.Id, nil)
+	req.AddCookie(cookie)
+	req.Header.Set(CSRFHeader, a.CSRFToken(req))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || call("GET", minted.Token, &Rule{Trust: 1}) {
+		t.Errorf("revoked token still works: %v", rec.Code)
+	}
+
+	a.DeleteUser(u.Uuid)
+	if tokens, _ = a.APITokens(u.Uuid); len(tokens) != 0 {
+		t.Errorf("deleted user's tokens remain")
+	}
+}
+
+func TestScopedAPITokens(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/scoped-tokens"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	u, _ := a.NewUser("root@example.com", "pw", true, 1000000000)
+	u.UniqueName = "root"
+	u.Save()
+	_, token, err := a.NewScopedAPIToken(u, "backups", 0, TokenScope{
+		Paths:    []string{"/private-files/backups/"},
+		Methods:  []string{"GET"},
+		MaxTrust: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := false
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true })
+	call := func(method, path string, rule *Rule) bool {
+		served = false
+		req := httptest.NewRequest(method, "/", nil)
+		req.URL.Path = path
+		req.Header.Set("Authorization", "Bearer "+token)
+		a.Wrap(ok, rule).ServeHTTP(httptest.NewRecorder(), req)
+		return served
+	}
+	if !call("GET", "/private-files/backups/db.tar", &Rule{Trust: 2}) {
+		t.Errorf("scoped token refused in scope")
+	}
+	if !call("HEAD", "/private-files/backups/db.tar", &Rule{Trust: 2}) {
+		t.Errorf("GET scope didn't allow HEAD")
+	}
+	for _, p := range []string{"/private-files/other", "/private-files/backups/../secrets", "/private-files/backupsx"} {
+		if call("GET", p, &Rule{Trust: 1}) {
+			t.Errorf("%s outside the scope allowed", p)
+		}
+	}
+	if call("PUT", "/private-files/backups/db.tar", &Rule{Trust: 1, CSRF: true}) {
+		t.Errorf("method outside the scope allowed")
+	}
+	if call("GET", "/private-files/backups/db.tar", &Rule{Trust: 3}) {
+		t.Errorf("trust cap ignored")
+	}
+	if call("GET", "/private-files/backups/db.tar", &Rule{Admin: true}) {
+		t.Errorf("capped token acted as admin")
+	}
+	if call("GET", "/private-files/backups/db.tar", &Rule{TrustExactly: 2}) {
+		t.Errorf("capped token passed TrustExactly")
+	}
+	plain, _ := a.NewUser("plain@example.com", "pw", false, 2)
+	plain.UniqueName = "plain"
+	plain.Save()
+	_, token, _ = a.NewScopedAPIToken(plain, "loose cap", 0, TokenScope{MaxTrust: 5})
+	if !call("GET", "/", &Rule{TrustExactly: 2}) {
+		t.Errorf("cap above the user's trust failed TrustExactly")
+	}
+
+	// handlers acting as the user don't take capped tokens
+	_, token, _ = a.NewScopedAPIToken(u, "low", 0, TokenScope{MaxTrust: 1})
+	req := httptest.NewRequest("POST", "/invite", strings.NewReader(url.Values{
+		"email": {"sneaky@example.com"}, "admin": {"true"}, "trust": {"100"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	a.InviteHandler().ServeHTTP(w, req)
+	if pending, _ := a.ListPendingInvitations(); len(pending) != 0 || w.Code == http.StatusOK {
+		t.Errorf("capped admin token invited: %v %v", w.Code, pending)
+	}
+	if _, _, err := a.NewScopedAPIToken(u, "bad", 0, TokenScope{MaxTrust: -1}); err == nil {
+		t.Errorf("negative trust cap accepted")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/basic", BasicRealm: "files", MaxLoginFailures: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	u, _ := a.NewUser("dav@example.com", "davpass", false, 2)
+	u.UniqueName = "dav"
+	u.Save()
+
+	var seen User
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = a.getSession(r)
+	}), &Rule{Trust: 2, CSRF: true, BasicAuth: true})
+	do := func(method, name, pw, origin string) *httptest.ResponseRecorder {
+		seen = User{}
+		req := httptest.NewRequest(method, "/dav/", nil)
+		if name != "" {
+			req.SetBasicAuth(name, pw)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := do("GET", "", "", "")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != `Basic realm="files", charset="UTF-8"` {
+		t.Errorf("no challenge: %v %v", rec.Code, rec.Header())
+	}
+	rec = do("GET", "dav", "davpass", "")
+	if rec.Code != 200 || seen.Uuid != u.Uuid || rec.Header().Get("Set-Cookie") != "" {
+		t.Errorf("basic login failed: %v %+v %v", rec.Code, seen, rec.Header())
+	}
+	if rec = do("PUT", "dav", "davpass", ""); rec.Code != 200 {
+		t.Errorf("originless basic write refused: %v", rec.Code)
+	}
+	if rec = do("PUT", "dav", "davpass", "http://evil.example"); rec.Code != http.StatusForbidden {
+		t.Errorf("cross-origin basic write allowed: %v", rec.Code)
+	}
+
+	// rights are checked as usual, without asking again
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/dav/", nil)
+	req.SetBasicAuth("dav", "davpass")
+	a.Wrap(http.NotFoundHandler(), &Rule{Trust: 3, BasicAuth: true}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("insufficient trust: %v", rec.Code)
+	}
+
+	// failures count towards the lockout
+	for i := 0; i < 2; i++ {
+		if rec = do("GET", "dav", "wrong", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("wrong password: %v", rec.Code)
+		}
+	}
+	if rec = do("GET", "dav", "davpass", ""); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("no lockout: %v", rec.Code)
+	}
+
+	// rules without BasicAuth ignore the header
+	{
+		h := a.Wrap(http.NotFoundHandler(), &Rule{Trust: 1, Redirect: "/login"})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("dav", "davpass")
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 302 {
+			t.Errorf("basic credentials used without BasicAuth: %v", rec.Code)
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/groups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	newUser := func(name string, trust int, groups ...string) *User {
+		u, _ := a.NewUser(name+"@example.com", "pw", false, trust)
+		u.UniqueName = name
+		u.Save()
+		for _, g := range groups {
+			err := a.AddToGroup(u.Uuid, g)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		u, _ = u.Load()
+		return u
+	}
+	photographer := newUser("photographer", 1, "photo-club")
+	editor := newUser("editor", 5, "editors", "photo-club")
+	other := newUser("other", 5)
+
+	if err := a.AddToGroup(other.Uuid, "bad name"); err == nil {
+		t.Errorf("invalid group name accepted")
+	}
+	groups, _ := a.Groups()
+	if groups["photo-club"] != 2 || groups["editors"] != 1 || len(groups) != 2 {
+		t.Errorf("groups: %v", groups)
+	}
+	members, _ := a.GroupMembers("editors")
+	if len(members) != 1 || members[0].Uuid != editor.Uuid {
+		t.Errorf("members: %v", members)
+	}
+
+	allowed := func(u *User, rule *Rule) bool {
+		cookie, _ := u.Cookie()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		served := false
+		a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }), rule).
+			ServeHTTP(httptest.NewRecorder(), req)
+		return served
+	}
+	clubOrEditors := &Rule{AnyGroup: []string{"photo-club", "editors"}}
+	if !allowed(photographer, clubOrEditors) || !allowed(editor, clubOrEditors) || allowed(other, clubOrEditors) {
+		t.Errorf("any-of groups misapplied")
+	}
+	both := &Rule{AllGroups: []string{"photo-club", "editors"}}
+	if allowed(photographer, both) || !allowed(editor, both) {
+		t.Errorf("all-of groups misapplied")
+	}
+	trustedClub := &Rule{Trust: 5, AnyGroup: []string{"photo-club"}}
+	if allowed(photographer, trustedClub) || !allowed(editor, trustedClub) || allowed(other, trustedClub) {
+		t.Errorf("groups with trust misapplied")
+	}
+	if allowed(other, &Rule{}) {
+		t.Errorf("empty rule allowed")
+	}
+
+	// leaving a group takes effect on existing sessions
+	cookie, _ := photographer.Cookie()
+	a.RemoveFromGroup(photographer.Uuid, "photo-club")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	if a.getSession(req).Uuid != "" {
+		t.Errorf("session survived a group change")
+	}
+	a.DeleteGroup("photo-club")
+	if groups, _ = a.Groups(); len(groups) != 1 {
+		t.Errorf("group not deleted: %v", groups)
+	}
+
+	var out bytes.Buffer
+	if err := a.RunCommand([]string{"group", "add", "editors", "other"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	a.RunCommand([]string{"group", "list"}, &out)
+	if !strings.Contains(out.String(), "editors  2") {
+		t.Errorf("group list: %q", out.String())
+	}
+}
+
+func TestAuthorizers(t *testing.T) {
+	a, err := NewAuthenticator(Opts{DataDir: *testDataDir + "/authorizers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	reader, _ := a.NewUser("reader@example.com", "pw", false, 1)
+	reader.Save()
+	writer, _ := a.NewUser("writer@example.com", "pw", false, 5)
+	writer.Save()
+	banned, _ := a.NewUser("banned@example.com", "pw", false, 5)
+	banned.Save()
+	a.AddToGroup(banned.Uuid, "banned")
+	banned, _ = banned.Load()
+
+	allowed := func(u *User, method string, az Authorizer) bool {
+		req := httptest.NewRequest(method, "/wiki/", nil)
+		if u != nil {
+			cookie, _ := u.Cookie()
+			req.AddCookie(cookie)
+			req.Header.Set(CSRFHeader, a.CSRFToken(req))
+		}
+		served := false
+		a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }), az).
+			ServeHTTP(httptest.NewRecorder(), req)
+		return served
+	}
+
+	wiki := Methods{
+		"GET": &Rule{Trust: 1},
+		"*":   &Rule{Trust: 5, CSRF: true},
+	}
+	if !allowed(reader, "GET", wiki) || !allowed(reader, "HEAD", wiki) || allowed(reader, "POST", wiki) {
+		t.Errorf("reader misjudged")
+	}
+	if !allowed(writer, "GET", wiki) || !allowed(writer, "POST", wiki) || allowed(nil, "GET", wiki) {
+		t.Errorf("writer or nobody misjudged")
+	}
+	if allowed(writer, "POST", Methods{"GET": &Rule{Trust: 1}}) {
+		t.Errorf("unlisted method allowed")
+	}
+
+	// the picked rule's CSRF setting applies
+	cookie, _ := writer.Cookie()
+	req := httptest.NewRequest("POST", "/wiki/", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	a.Wrap(http.NotFoundHandler(), wiki).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("csrf not checked: %v", rec.Code)
+	}
+
+	notBanned := AllOf(&Rule{Trust: 1}, Not(&Rule{AnyGroup: []string{"banned"}}))
+	if !allowed(writer, "GET", notBanned) || allowed(banned, "GET", notBanned) || allowed(nil, "GET", notBanned) {
+		t.Errorf("AllOf/Not misjudged")
+	}
+	either := AnyOf(&Rule{TrustExactly: 1}, &Rule{AnyGroup: []string{"banned"}})
+	if !allowed(reader, "GET", either) || !allowed(banned, "GET", either) || allowed(writer, "GET", either) {
+		t.Errorf("AnyOf misjudged")
+	}
+	if allowed(writer, "GET", AnyOf()) || allowed(writer, "GET", AllOf()) {
+		t.Errorf("empty combinators allowed")
+	}
+
+	// a redirect from inside a combinator is used
+	req = httptest.NewRequest("GET", "/wiki/", nil)
+	rec = httptest.NewRecorder()
+	a.Wrap(http.NotFoundHandler(), AllOf(&Rule{Trust: 1, Redirect: "/login"})).ServeHTTP(rec, req)
+	if rec.Code != 302 || rec.Header().Get("Location") != "/login" {
+		t.Errorf("redirect lost: %v", rec.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// CSRFHeader and CSRFField are where CSRF tokens are looked for, the
+	// header is preferred since reading the form consumes the request body.
+	CSRFHeader = "X-CSRF-Token"
+	CSRFField  = "csrf"
+)
+
+func tokensMatch(a, b string) bool {
+	return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// requestToken finds a CSRF token in the header or, for urlencoded forms,
+// the body.
+func requestToken(r *http.Request) string {
+	if t := r.Header.Get(CSRFHeader); t != "" {
+		return t
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/x-www-form-urlencoded" {
+		return r.PostFormValue(CSRFField)
+	}
+	return ""
+}
+
+// originStatus reports whether the request came with an Origin header, or
+// failing that a Referer, and whether it names this host.
+func originStatus(r *http.Request) (present, sameOrigin bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false, false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return true, false
+	}
+	return true, u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// CSRFToken returns the token wrapped handlers should embed in forms (as
+// the "csrf" field) or send in the X-CSRF-Token header for state changing
+// requests, it's empty if the request has no session.
+func (a *Authenticator) CSRFToken(r *http.Request) string {
+	c := a.currentClaims(r)
+	if c == nil {
+		return ""
+	}
+	return c.CSRF
+}
+
+func CSRFToken(r *http.Request) string {
+	return defaultAuth.CSRFToken(r)
+}
+
+// checkCSRF is applied by Wrap to non-safe methods for rules with CSRF set.
+// A cross-origin Origin always fails, otherwise either the session's token
+// or a same-origin Origin will do. Bearer tokens aren't sent by browsers
+// on their own, so they need neither. Basic credentials are, but clients
+// that need them seldom send an Origin, so only a cross-origin one fails.
+func checkCSRF(r *http.Request, c *sessionClaims) bool {
+	if safeMethod(r.Method) || (c != nil && c.bearer) {
+		return true
+	}
+	present, sameOrigin := originStatus(r)
+	if present && !sameOrigin {
+		return false
+	}
+	if c != nil && c.basic {
+		return true
+	}
+	if c != nil && tokensMatch(requestToken(r), c.CSRF) {
+		return true
+	}
+	return present && sameOrigin
+}
+
+// The login form has no session to tie a token to, so it uses a double
+// submitted cookie instead: a cross-site form can't know its value.
+func (a *Authenticator) loginCSRFCookieName() string {
+	return a.sessionCookieName() + "-csrf"
+}
+
+func (a *Authenticator) setLoginCSRF(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(a.loginCSRFCookieName()); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+	token, err := newSessionId()
+	if err != nil {
+		return "", err
+	}
+	c := a.newCookie(token, r)
+	c.Name = a.loginCSRFCookieName()
+	c.MaxAge = 0
+	c.Expires = time.Time{}
+	http.SetCookie(w, c)
+	return token, nil
+}
+
+func (a *Authenticator) checkLoginCSRF(r *http.Request) bool {
+	present, sameOrigin := originStatus(r)
+	if present && !sameOrigin {
+		return false
+	}
+	c, err := r.Cookie(a.loginCSRFCookieName())
+	if err != nil {
+		return false
+	}
+	return tokensMatch(r.PostFormValue(CSRFField), c.Value)
+}
+
+func renderLoginForm(token, message string) string {
+	form := strings.Replace(LoginForm, "{{error}}", html.EscapeString(message), 1)
+	return strings.Replace(form, "{{csrf}}", html.EscapeString(token), 1)
+}
+
+func renderSecondFactorForm(pending, token string) string {
+	form := strings.Replace(SecondFactorForm, "{{pending}}", html.EscapeString(pending), 1)
+	return strings.Replace(form, "{{csrf}}", html.EscapeString(token), 1)
+}
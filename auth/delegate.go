@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// outstandingInvitations counts the accounts a user's invitations have
+// made or may still make, revoked and expired ones don't count.
+func outstandingInvitations(tx *bolt.Tx, inviterUuid string) (int, error) {
+	n := 0
+	err := tx.Bucket([]byte("invitations")).ForEach(func(k, v []byte) error {
+		inv, err := decodeInvitation(v)
+		if err != nil {
+			return err
+		}
+		if inv.Creator != inviterUuid ||
+			(inv.Status != InvitationPending && inv.Status != InvitationAccepted) {
+			return nil
+		}
+		if inv.MaxRedemptions > 0 {
+			n += inv.MaxRedemptions
+		} else {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// quotaFor is the user's own quota if set, the realm's otherwise.
+func (a *Authenticator) quotaFor(u *User) int {
+	if u.InviteQuota > 0 {
+		return u.InviteQuota
+	}
+	return a.inviteQuota
+}
+
+// DelegateInvitation issues an invitation on behalf of inviter. Admins may
+// invite anyone, everyone else only non-admins with less trust than their
+// own, and no more than their invite quota.
+func (a *Authenticator) DelegateInvitation(inviter *User, o InvitationOpts) (*Invitation, string, error) {
+	inviter, err := inviter.Load()
+	if err != nil || inviter == nil || !inviter.Active {
+		return nil, "", errors.New("unauthorized")
+	}
+	o.Creator = inviter.Uuid
+	if inviter.Admin {
+		return a.NewInvitation(o)
+	}
+	if o.Admin {
+		return nil, "", errors.New("only admins may invite admins")
+	}
+	if o.Trust < 0 || o.Trust >= inviter.Trust {
+		return nil, "", errors.New("invited trust must be below your own")
+	}
+	wanted := 1
+	if o.MaxRedemptions > 0 {
+		wanted = o.MaxRedemptions
+	}
+	quota := a.quotaFor(inviter)
+	// counted in the transaction the invitation is saved in, so concurrent
+	// requests can't both fit in the last slot
+	return a.newInvitation(o, func(tx *bolt.Tx) error {
+		n, err := outstandingInvitations(tx, inviter.Uuid)
+		if err != nil {
+			return err
+		}
+		if n+wanted > quota {
+			return errors.New("invite quota exceeded")
+		}
+		return nil
+	})
+}
+
+func DelegateInvitation(inviter *User, o InvitationOpts) (*Invitation, string, error) {
+	return defaultAuth.DelegateInvitation(inviter, o)
+}
+
+// InviteHandler lets any logged in user POST email, trust and optionally
+// admin, max_redemptions and ttl (in hours) form values to invite
+// others, within the limits of DelegateInvitation. GET lists the user's
+// pending invitations. Both answer in JSON, new invitations come with a
+// url when Opts.PublicURL is set.
+func (a *Authenticator) InviteHandler() http.Handler {
+	return a.Wrap(http.HandlerFunc(a.serveInvite), &Rule{Trust: 1, CSRF: true})
+}
+
+func InviteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultAuth.InviteHandler().ServeHTTP(w, r)
+	})
+}
+
+func (a *Authenticator) serveInvite(w http.ResponseWriter, r *http.Request) {
+	inviter := a.getSession(r)
+	if inviter.Uuid == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		pending, err := a.ListPendingInvitations()
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		mine := []*Invitation{}
+		for _, inv := range pending {
+			if inv.Creator == inviter.Uuid {
+				mine = append(mine, inv)
+			}
+		}
+		writeJSON(w, mine)
+	case "POST":
+		trust, _ := strconv.Atoi(r.FormValue("trust"))
+		maxRedemptions, _ := strconv.Atoi(r.FormValue("max_redemptions"))
+		hours, _ := strconv.ParseFloat(r.FormValue("ttl"), 64)
+		inv, token, err := a.DelegateInvitation(&inviter, InvitationOpts{
+			Email:          r.FormValue("email"),
+			Admin:          r.FormValue("admin") == "true",
+			Trust:          trust,
+			TTL:            time.Duration(hours * float64(time.Hour)),
+			MaxRedemptions: maxRedemptions,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		res := map[string]interface{}{"invitation": inv, "token": token}
+		if link, err := a.InvitationURL(token); err == nil {
+			res["url"] = link
+		}
+		writeJSON(w, res)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	bits, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bits)
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// validGroupName keeps group names usable on a command line and in a form.
+func validGroupName(group string) error {
+	if group == "" || strings.IndexFunc(group, func(r rune) bool {
+		return unicode.IsSpace(r) || r == ','
+	}) >= 0 {
+		return errors.New("group names must be non-empty, without spaces or commas")
+	}
+	return nil
+}
+
+// normalizeGroups checks group names and sorts them without duplicates,
+// which is how users always hold them.
+func normalizeGroups(groups []string) ([]string, error) {
+	set := []string{}
+	for _, g := range groups {
+		err := validGroupName(g)
+		if err != nil {
+			return nil, err
+		}
+		if !contains(set, g) {
+			set = append(set, g)
+		}
+	}
+	sort.Strings(set)
+	return set, nil
+}
+
+// InGroup reports whether u is a member of group.
+func (u *User) InGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// SetGroups replaces a user's groups, which like changing trust ends
+// their sessions.
+func (a *Authenticator) SetGroups(userUuid string, groups []string) error {
+	set, err := normalizeGroups(groups)
+	if err != nil {
+		return err
+	}
+	u, err := (&User{Uuid: userUuid, a: a}).Load()
+	if err != nil || u == nil || u.Uuid != userUuid {
+		return errors.New("no user")
+	}
+	u.Groups = set
+	return u.Save()
+}
+
+func SetGroups(userUuid string, groups []string) error {
+	return defaultAuth.SetGroups(userUuid, groups)
+}
+
+// AddToGroup makes a user a member of group, groups exist as long as they
+// have members.
+func (a *Authenticator) AddToGroup(userUuid, group string) error {
+	u, err := (&User{Uuid: userUuid, a: a}).Load()
+	if err != nil || u == nil || u.Uuid != userUuid {
+		return errors.New("no user")
+	}
+	if u.InGroup(group) {
+		return nil
+	}
+	return a.SetGroups(userUuid, append(u.Groups, group))
+}
+
+func AddToGroup(userUuid, group string) error {
+	return defaultAuth.AddToGroup(userUuid, group)
+}
+
+func (a *Authenticator) RemoveFromGroup(userUuid, group string) error {
+	u, err := (&User{Uuid: userUuid, a: a}).Load()
+	if err != nil || u == nil || u.Uuid != userUuid {
+		return errors.New("no user")
+	}
+	if !u.InGroup(group) {
+		return nil
+	}
+	var rest []string
+	for _, g := range u.Groups {
+		if g != group {
+			rest = append(rest, g)
+		}
+	}
+	return a.SetGroups(userUuid, rest)
+}
+
+func RemoveFromGroup(userUuid, group string) error {
+	return defaultAuth.RemoveFromGroup(userUuid, group)
+}
+
+// Groups counts the members of every group.
+func (a *Authenticator) Groups() (map[string]int, error) {
+	groups := make(map[string]int)
+	err := a.eachUser(func(u *User) {
+		for _, g := range u.Groups {
+			groups[g]++
+		}
+	})
+	return groups, err
+}
+
+func Groups() (map[string]int, error) {
+	return defaultAuth.Groups()
+}
+
+// GroupMembers lists the members of group, oldest first.
+func (a *Authenticator) GroupMembers(group string) ([]*User, error) {
+	var members []*User
+	err := a.eachUser(func(u *User) {
+		if u.InGroup(group) {
+			members = append(members, u)
+		}
+	})
+	return members, err
+}
+
+func GroupMembers(group string) ([]*User, error) {
+	return defaultAuth.GroupMembers(group)
+}
+
+// DeleteGroup removes everyone from group.
+func (a *Authenticator) DeleteGroup(group string) error {
+	members, err := a.GroupMembers(group)
+	if err != nil {
+		return err
+	}
+	for _, u := range members {
+		err = a.RemoveFromGroup(u.Uuid, group)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteGroup(group string) error {
+	return defaultAuth.DeleteGroup(group)
+}
+
+func (a *Authenticator) eachUser(f func(u *User)) error {
+	return a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+			u := a.deserializeUser(v)
+			if u == nil {
+				return errors.New("unlikely deserialization error")
+			}
+			f(u)
+			return nil
+		})
+	})
+}
+
+func sameGroups(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, g := range a {
+		if !contains(b, g) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// inGroups checks the group requirements of a rule.
+func (rule *Rule) inGroups(u *Subject) bool {
+	for _, g := range rule.AllGroups {
+		if !contains(u.Groups, g) {
+			return false
+		}
+	}
+	if len(rule.AnyGroup) == 0 {
+		return true
+	}
+	for _, g := range rule.AnyGroup {
+		if contains(u.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
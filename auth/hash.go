@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// ErrUnknownHash is what a PasswordHasher's Verify returns for hashes it
+// didn't make, the built in hashers are tried next so that hashes from
+// before a change of hasher keep working until they're upgraded.
+var ErrUnknownHash = errors.New("unknown password hash")
+
+// A PasswordHasher makes and checks what's kept in User.EncryptedPassword.
+type PasswordHasher interface {
+	Hash(password []byte) (string, error)
+	Verify(hash string, password []byte) error
+	// NeedsRehash reports whether hash should be replaced on the next
+	// login, because another scheme or weaker parameters made it.
+	NeedsRehash(hash string) bool
+}
+
+// BcryptHasher is the default hasher, Cost defaults to bcrypt.DefaultCost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h *BcryptHasher) Hash(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, h.cost())
+	return string(hash), err
+}
+
+func (h *BcryptHasher) Verify(hash string, password []byte) error {
+	if !strings.HasPrefix(hash, "$2") {
+		return ErrUnknownHash
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), password)
+}
+
+func (h *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.cost()
+}
+
+// Argon2Hasher hashes with argon2id, keeping its parameters in the PHC
+// string format. Unset parameters take the RFC 9106 second recommended
+// option: one pass over 64 MiB with four lanes.
+type Argon2Hasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+type argon2Params struct {
+	time, memory uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func (h *Argon2Hasher) params() argon2Params {
+	p := argon2Params{time: h.Time, memory: h.Memory, threads: h.Threads}
+	if p.time == 0 {
+		p.time = 1
+	}
+	if p.memory == 0 {
+		p.memory = 64 * 1024
+	}
+	if p.threads == 0 {
+		p.threads = 4
+	}
+	p.key = make([]byte, h.KeyLen)
+	if h.KeyLen == 0 {
+		p.key = make([]byte, 32)
+	}
+	p.salt = make([]byte, h.SaltLen)
+	if h.SaltLen == 0 {
+		p.salt = make([]byte, 16)
+	}
+	return p
+}
+
+func (h *Argon2Hasher) Hash(password []byte) (string, error) {
+	p := h.params()
+	_, err := rand.Read(p.salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(p.salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func parseArgon2(hash string) (p argon2Params, err error) {
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, ErrUnknownHash
+	}
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, errors.New("unsupported argon2 version")
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return p, err
+	}
+	p.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, err
+	}
+	p.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	return p, err
+}
+
+func (h *Argon2Hasher) Verify(hash string, password []byte) error {
+	p, err := parseArgon2(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey(password, p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return errors.New("password mismatch")
+	}
+	return nil
+}
+
+func (h *Argon2Hasher) NeedsRehash(hash string) bool {
+	stored, err := parseArgon2(hash)
+	if err != nil {
+		return true
+	}
+	want := h.params()
+	return stored.time < want.time || stored.memory < want.memory ||
+		stored.threads < want.threads || len(stored.salt) < len(want.salt) ||
+		len(stored.key) < len(want.key)
+}
+
+// builtinHashers verify hashes the configured hasher doesn't recognize.
+var builtinHashers = []PasswordHasher{&BcryptHasher{}, &Argon2Hasher{}}
+
+// pepperedPrefix marks hashes of the peppered password, so that turning
+// the pepper on doesn't lock out everyone hashed without it.
+const pepperedPrefix = "$peppered"
+
+func (a *Authenticator) pepper(password string) []byte {
+	mac := hmac.New(sha256.New, []byte(a.passwordPepper))
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (a *Authenticator) hashPassword(password string) (string, error) {
+	if a.passwordPepper == "" {
+		return a.passwordHasher.Hash([]byte(password))
+	}
+	hash, err := a.passwordHasher.Hash(a.pepper(password))
+	if err != nil {
+		return "", err
+	}
+	return pepperedPrefix + hash, nil
+}
+
+func (a *Authenticator) checkPassword(hash, password string) error {
+	pw := []byte(password)
+	if strings.HasPrefix(hash, pepperedPrefix) {
+		if a.passwordPepper == "" {
+			return errors.New("password hash needs the pepper")
+		}
+		hash = strings.TrimPrefix(hash, pepperedPrefix)
+		pw = a.pepper(password)
+	}
+	err := a.passwordHasher.Verify(hash, pw)
+	for _, h := range builtinHashers {
+		if err != ErrUnknownHash {
+			break
+		}
+		err = h.Verify(hash, pw)
+	}
+	return err
+}
+
+// needsRehash is true of hashes made without the pepper, by another
+// hasher, or with weaker parameters.
+func (a *Authenticator) needsRehash(hash string) bool {
+	if (a.passwordPepper != "") != strings.HasPrefix(hash, pepperedPrefix) {
+		return true
+	}
+	return a.passwordHasher.NeedsRehash(strings.TrimPrefix(hash, pepperedPrefix))
+}
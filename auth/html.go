@@ -16,6 +16,7 @@ func mkHtml(body string) string {
 
 const LoginForm = `
 <form id=login action="" method="POST">
+	<p class=error>{{error}}</p>
 	Name or email:
 	<p>
 		<input type="text" name="username" />
@@ -24,6 +25,7 @@ const LoginForm = `
 	<p>
 		<input type="password" name="password" />
 	</p>
+	<input type="hidden" name="csrf" value="{{csrf}}" />
 	<button type="submit">Submit</button>
 </form>
 
@@ -37,10 +39,39 @@ function getURLParameter(name) {
   if (window.location.search.indexOf('invite=') !== -1) {
     var invite = getURLParameter("invite"),
         loginForm = document.querySelector("#login"),
-        post = window.location+'?='+invite;
+        post = window.location.pathname+'?invite='+encodeURIComponent(invite);
     loginForm.setAttribute("action", post);
+  }
 })();
 
 </script>
 
 `
+
+const SecondFactorForm = `
+<form id=second-factor action="" method="POST">
+	Code from your authenticator app, or a recovery code:
+	<p>
+		<input type="text" name="code" autocomplete="one-time-code" autofocus />
+	</p>
+	<input type="hidden" name="totp_pending" value="{{pending}}" />
+	<input type="hidden" name="csrf" value="{{csrf}}" />
+	<button type="submit">Submit</button>
+</form>
+`
+
+const ResetForm = `
+<form id=reset action="" method="POST">
+	<p class=error>{{error}}</p>
+	New password:
+	<p>
+		<input type="password" name="password" />
+	</p>
+	Again:
+	<p>
+		<input type="password" name="confirm" />
+	</p>
+	<input type="hidden" name="reset" value="{{reset}}" />
+	<button type="submit">Submit</button>
+</form>
+`
@@ -2,19 +2,28 @@ package auth
 
 import (
 	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/fernet/fernet-go"
+	"net/http"
 	"os"
 	"path"
+	"sync"
 	"time"
 )
 
 var (
-	dataDir             string  = ""
-	defaultDir          string  = "boring-server"
-	configPrefix        string  = "BORING_SERVER_"
-	keyRotationInterval float64 = 99.0
-	numberOfKeys        int     = 3
-	dbName              string  = "boring.db"
-	cookieName          string  = "cookie"
+	defaultDir                 string        = "boring-server"
+	defaultConfigPrefix        string        = "BORING_SERVER_"
+	defaultKeyRotationInterval float64       = 99.0
+	defaultNumberOfKeys        int           = 3
+	defaultDBName              string        = "boring.db"
+	defaultCookieName          string        = "cookie"
+	defaultMaxLoginFailures    int           = 10
+	defaultLoginBackoff        time.Duration = time.Second
+	defaultLoginLockout        time.Duration = 15 * time.Minute
+	defaultPasswordResetTTL    time.Duration = time.Hour
+	defaultInvitationTTL       time.Duration = 7 * 24 * time.Hour
+	defaultInviteQuota         int           = 5
 )
 
 type Opts struct {
@@ -24,81 +33,292 @@ type Opts struct {
 	NumberOfKeys        int
 	DBName              string
 	CookieName          string
+	// Keys are rotated every KeyRotationInterval hours in the background
+	// unless ManualKeyRotation is set.
+	ManualKeyRotation bool
+
+	// Session cookies are always HttpOnly with path "/", and are marked
+	// Secure when the login came over TLS even if CookieSecure is unset.
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+	// CookieDomain shares sessions with subdomains, e.g. "example.com".
+	CookieDomain string
+	// CookieMaxAge makes sessions persist across browser restarts, it's
+	// capped at how long the keys last. Zero means a browser session cookie.
+	CookieMaxAge time.Duration
+	// CookieHostPrefix names the cookie "__Host-" + CookieName, which implies
+	// Secure and is incompatible with CookieDomain.
+	CookieHostPrefix bool
+
+	// After a few failed logins for a username or from an address, further
+	// attempts have to wait LoginBackoff, doubling with each failure. At
+	// MaxLoginFailures they're locked out for LoginLockout, which is also how
+	// long failures are remembered.
+	MaxLoginFailures int
+	LoginBackoff     time.Duration
+	LoginLockout     time.Duration
+
+	// PasswordResetTTL is how long NewPasswordReset tokens work for.
+	PasswordResetTTL time.Duration
+	// InvitationTTL is the default lifetime of invitations, tokens can't
+	// outlive the keys in any case.
+	InvitationTTL time.Duration
+	// InviteQuota is how many accounts a non-admin may have invited through
+	// DelegateInvitation, counting pending and accepted invitations.
+	InviteQuota int
+
+	// PublicURL is where invitation links lead, any page behind Wrap
+	// will do since it shows the login form, e.g.
+	// "https://example.com/admin/". It can also be set with the
+	// PUBLIC_URL environment variable (after ConfigPrefix).
+	PublicURL string
+
+	// PasswordHasher defaults to bcrypt at its default cost. Passwords
+	// hashed some other way are rehashed the next time their user logs in.
+	PasswordHasher PasswordHasher
+	// PasswordPepper is a secret mixed into every password hash, better
+	// kept out of the data dir in the PASSWORD_PEPPER environment variable
+	// (after ConfigPrefix). Users hashed before it was set are rehashed with
+	// it on their next login, changing it makes everyone reset passwords.
+	PasswordPepper string
+
+	// New passwords, whether set by accepting an invitation, a reset or
+	// ChangePassword, must be at least MinPasswordLength characters and at
+	// most MaxPasswordLength bytes, 72 by default since bcrypt ignores the
+	// rest. DisallowNameInPassword refuses ones containing the user name.
+	MinPasswordLength      int
+	MaxPasswordLength      int
+	DisallowNameInPassword bool
+	// BreachedPasswords is the path of a sorted list of SHA-1 hashes of
+	// known passwords to refuse, see CheckPassword.
+	BreachedPasswords string
+
+	// BasicRealm names the realm in challenges of rules with BasicAuth.
+	BasicRealm string
 }
 
-var maxDuration time.Duration
+// An Authenticator is one auth realm: its own user db, keys, cookie and
+// login handler. Several may be used side by side in one process as long
+// as they are given distinct data dirs (or db names and cookie names).
+type Authenticator struct {
+	dataDir             string
+	configPrefix        string
+	keyRotationInterval float64
+	numberOfKeys        int
+	dbName              string
+	cookieName          string
+	cookieSecure        bool
+	cookieSameSite      http.SameSite
+	cookieDomain        string
+	cookieMaxAge        time.Duration
+	cookieHostPrefix    bool
+	maxLoginFailures    int
+	loginBackoff        time.Duration
+	loginLockout        time.Duration
+	passwordResetTTL    time.Duration
+	invitationTTL       time.Duration
+	inviteQuota         int
+	publicURL           string
+	passwordHasher      PasswordHasher
+	passwordPepper      string
+	minPasswordLength   int
+	maxPasswordLength   int
+	noNameInPassword    bool
+	breachedPasswords   string
+	basicRealm          string
 
-func NewWithOpts(options Opts) error {
-	if options.DataDir != "" {
-		dataDir = options.DataDir
+	maxDuration      time.Duration
+	authKeyFile      string
+	rotationTimeFile string
+	secretKeyFile    string
+	secretKey        *fernet.Key
+	keyLock          sync.RWMutex
+	activeKeys       []*fernet.Key
+	stop             chan struct{}
+	stopOnce         sync.Once
+	running          sync.WaitGroup
+	db               *bolt.DB
+	authz            authzCache
+	loginHandler     *http.ServeMux
+	dummyHash        string
+	// now is the clock for lockouts, resets, invitations, API tokens and
+	// key rotation, tests move it by hand.
+	now func() time.Time
+}
+
+// defaultAuth backs the package level functions (Wrap, NewUserInvitation,
+// etc.), it is set up by New or NewWithOpts.
+var defaultAuth *Authenticator
+
+func NewAuthenticator(options Opts) (*Authenticator, error) {
+	a := &Authenticator{
+		dataDir:             options.DataDir,
+		configPrefix:        defaultConfigPrefix,
+		keyRotationInterval: defaultKeyRotationInterval,
+		numberOfKeys:        defaultNumberOfKeys,
+		dbName:              defaultDBName,
+		cookieName:          defaultCookieName,
+		cookieSecure:        options.CookieSecure,
+		cookieSameSite:      options.CookieSameSite,
+		cookieDomain:        options.CookieDomain,
+		cookieMaxAge:        options.CookieMaxAge,
+		cookieHostPrefix:    options.CookieHostPrefix,
+		maxLoginFailures:    defaultMaxLoginFailures,
+		loginBackoff:        defaultLoginBackoff,
+		loginLockout:        defaultLoginLockout,
+		passwordResetTTL:    defaultPasswordResetTTL,
+		invitationTTL:       defaultInvitationTTL,
+		inviteQuota:         defaultInviteQuota,
+		publicURL:           options.PublicURL,
+		passwordHasher:      options.PasswordHasher,
+		passwordPepper:      options.PasswordPepper,
+		minPasswordLength:   options.MinPasswordLength,
+		maxPasswordLength:   defaultMaxPasswordLength,
+		noNameInPassword:    options.DisallowNameInPassword,
+		breachedPasswords:   options.BreachedPasswords,
+		basicRealm:          defaultBasicRealm,
+		now:                 time.Now,
+	}
+	if a.cookieHostPrefix && a.cookieDomain != "" {
+		return nil, errors.New("__Host- cookies cannot set a domain")
 	}
 	if options.ConfigPrefix != "" {
-		configPrefix = options.ConfigPrefix
+		a.configPrefix = options.ConfigPrefix
 	}
 	if options.DBName != "" {
-		dbName = options.DBName
+		a.dbName = options.DBName
 	}
 	if options.CookieName != "" {
-		cookieName = options.CookieName
+		a.cookieName = options.CookieName
 	}
 	if options.KeyRotationInterval != 0.0 {
-		keyRotationInterval = options.KeyRotationInterval
+		a.keyRotationInterval = options.KeyRotationInterval
 	}
 	if options.NumberOfKeys != 0 {
-		numberOfKeys = options.NumberOfKeys
+		a.numberOfKeys = options.NumberOfKeys
+	}
+	if options.MaxLoginFailures != 0 {
+		a.maxLoginFailures = options.MaxLoginFailures
+	}
+	if options.LoginBackoff != 0 {
+		a.loginBackoff = options.LoginBackoff
+	}
+	if options.LoginLockout != 0 {
+		a.loginLockout = options.LoginLockout
+	}
+	if options.PasswordResetTTL != 0 {
+		a.passwordResetTTL = options.PasswordResetTTL
+	}
+	if options.InvitationTTL != 0 {
+		a.invitationTTL = options.InvitationTTL
+	}
+	if options.InviteQuota != 0 {
+		a.inviteQuota = options.InviteQuota
+	}
+	if options.BasicRealm != "" {
+		a.basicRealm = options.BasicRealm
+	}
+	if options.MaxPasswordLength != 0 {
+		a.maxPasswordLength = options.MaxPasswordLength
+	}
+	if a.passwordHasher == nil {
+		a.passwordHasher = &BcryptHasher{}
+	}
+	err := a.init()
+	if err != nil {
+		return nil, err
+	}
+	if !options.ManualKeyRotation {
+		a.background(a.rotateOnSchedule)
+	}
+	a.background(a.sweep)
+	return a, nil
+}
+
+func NewWithOpts(options Opts) error {
+	a, err := NewAuthenticator(options)
+	if err != nil {
+		return err
 	}
-	return New()
+	defaultAuth = a
+	return nil
 }
 
 func New() error {
-	maxDuration = time.Duration(int64(keyRotationInterval*3.6e12) * int64(numberOfKeys))
-	dataDirFromEnv := os.Getenv(configPrefix + "DATA_DIR")
-	if dataDirFromEnv != "" {
-		dataDir = dataDirFromEnv
+	return NewWithOpts(Opts{})
+}
+
+func (a *Authenticator) init() error {
+	a.maxDuration = time.Duration(int64(a.keyRotationInterval*3.6e12) * int64(a.numberOfKeys))
+	publicURLFromEnv := os.Getenv(a.configPrefix + "PUBLIC_URL")
+	if publicURLFromEnv != "" {
+		a.publicURL = publicURLFromEnv
+	}
+	pepperFromEnv := os.Getenv(a.configPrefix + "PASSWORD_PEPPER")
+	if pepperFromEnv != "" {
+		a.passwordPepper = pepperFromEnv
 	}
-	err := setPathDefaults()
+	err := a.setPathDefaults()
 	if err != nil {
 		return err
 	}
-	if authKeyFile == "" {
+	a.dummyHash, err = a.hashPassword("no such user")
+	if err != nil {
+		return err
+	}
+	if a.authKeyFile == "" {
 		return errors.New("no keys available")
 	}
-	activeKeys, err = loadKeys()
+	a.activeKeys, err = a.loadKeys()
 	if err != nil {
-		activeKeys, err = createKeys(numberOfKeys)
+		keys, err := createKeys(a.numberOfKeys)
+		if err != nil {
+			return err
+		}
+		err = a.persistKeys(keys)
+		if err != nil {
+			return err
+		}
+	} else if _, err = a.lastRotationTime(); err != nil {
+		// keys predating rotation tracking start their clock now
+		err = a.persistRotationTime(a.now())
 		if err != nil {
 			return err
-		} else {
-			err = persistKeys(activeKeys)
-			if err != nil {
-				return err
-			}
 		}
 	}
-	err = initDb()
-	return err
-}
-
-func setPathDefaults() error {
-	home, err := homeDir()
+	a.secretKey, err = a.loadSecretKey()
 	if err != nil {
 		return err
 	}
-	if dataDir == "" {
-		dataDir = path.Join(home, ".config", defaultDir)
-		authKeyFile = path.Join(dataDir, "boring.keys")
-		err = os.MkdirAll(dataDir, 0755)
-		if err != nil {
-			return err
-		}
-		return nil
-	} else {
-		err = os.MkdirAll(dataDir, 0755)
+	a.loginHandler = http.NewServeMux()
+	a.loginHandler.Handle("/", http.HandlerFunc(a.Login))
+	return a.initDb()
+}
+
+// Close stops background work and releases the user db.
+func (a *Authenticator) Close() error {
+	a.Stop()
+	return a.db.Close()
+}
+
+func (a *Authenticator) setPathDefaults() error {
+	dataDirFromEnv := os.Getenv(a.configPrefix + "DATA_DIR")
+	if dataDirFromEnv != "" {
+		a.dataDir = dataDirFromEnv
+	}
+	if a.dataDir == "" {
+		home, err := homeDir()
 		if err != nil {
 			return err
 		}
-		authKeyFile = path.Join(dataDir, "boring.keys")
-		return nil
+		a.dataDir = path.Join(home, ".config", defaultDir)
+	}
+	err := os.MkdirAll(a.dataDir, 0755)
+	if err != nil {
+		return err
 	}
+	a.authKeyFile = path.Join(a.dataDir, "boring.keys")
+	a.rotationTimeFile = path.Join(a.dataDir, "boring.rotated")
+	a.secretKeyFile = path.Join(a.dataDir, "boring.secret-key")
 	return nil
 }
@@ -1,34 +1,430 @@
 package auth
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"github.com/boltdb/bolt"
+	"log"
+	"sort"
+	"time"
 )
 
-func NewUserInvitation(email string, admin bool, trust int) (*User, string, error) {
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationRevoked  = "revoked"
+	InvitationExpired  = "expired"
+)
+
+// sweepInterval is how often expired invitations, sessions and password
+// resets are looked for.
+const sweepInterval = time.Hour
+
+// An Invitation is tracked in the invitations bucket under the Uuid of the
+// placeholder User it will turn into when accepted.
+type Invitation struct {
+	Id         string
+	Email      string
+	Admin      bool
+	Trust      int
+	Creator    string
+	Created    time.Time
+	Expires    time.Time
+	Status     string
+	AcceptedAt time.Time
+	// Group invitations create a new User each time they're accepted, up to
+	// MaxRedemptions, and list the created Uuids in Redemptions.
+	MaxRedemptions int
+	Redemptions    []string
+}
+
+type InvitationOpts struct {
 	// Email can be anything (handle, empty, etc.), it's here
 	// as a way to keep track of outstanding invites without
 	// setting names in advance
-	u := &User{Email: email, Admin: admin, Trust: trust}
+	Email string
+	Admin bool
+	Trust int
+	// TTL defaults to Opts.InvitationTTL.
+	TTL time.Duration
+	// Creator is the Uuid of whoever issued the invitation, if anyone.
+	Creator string
+	// MaxRedemptions makes a group invitation that can be accepted that
+	// many times, each time creating a new account with Admin and Trust.
+	MaxRedemptions int
+}
+
+// inviteClaims is what an invitation token carries. Tokens from before
+// invitations were tracked carried the whole placeholder User, whose uuid
+// is the invitation id.
+type inviteClaims struct {
+	Kind       string `json:"k,omitempty"`
+	Id         string `json:"i,omitempty"`
+	LegacyUuid string `json:"uuid,omitempty"`
+}
+
+// NewUserInvitation invites someone on nobody's behalf, use NewInvitation
+// with a Creator or DelegateInvitation to record who brought them in.
+func NewUserInvitation(email string, admin bool, trust int) (*User, string, error) {
+	return defaultAuth.NewUserInvitation(email, admin, trust)
+}
+
+func (a *Authenticator) NewUserInvitation(email string, admin bool, trust int) (*User, string, error) {
+	inv, inviteText, err := a.NewInvitation(InvitationOpts{Email: email, Admin: admin, Trust: trust})
+	if err != nil {
+		return nil, "", err
+	}
+	u, err := (&User{Uuid: inv.Id, a: a}).Load()
+	if err != nil {
+		return nil, "", err
+	}
+	return u, inviteText, nil
+}
+
+func NewInvitation(o InvitationOpts) (*Invitation, string, error) {
+	return defaultAuth.NewInvitation(o)
+}
+
+// NewInvitation saves a passwordless placeholder user, unless it's a group
+// invitation, and returns the invitation along with the token to hand to
+// the invitee(s).
+func (a *Authenticator) NewInvitation(o InvitationOpts) (*Invitation, string, error) {
+	return a.newInvitation(o, nil)
+}
+
+// newInvitation runs check, if any, in the transaction that saves the
+// invitation, an error from it stops the invitation being made.
+func (a *Authenticator) newInvitation(o InvitationOpts, check func(tx *bolt.Tx) error) (*Invitation, string, error) {
+	if o.MaxRedemptions < 0 {
+		return nil, "", errors.New("negative redemption cap")
+	}
 	uid, err := seqUid()
 	if err != nil {
 		return nil, "", err
 	}
-	u.Uuid = uid
-	err = u.Save()
+	ttl := o.TTL
+	if ttl == 0 {
+		ttl = a.invitationTTL
+	}
+	if ttl > a.maxDuration {
+		ttl = a.maxDuration
+	}
+	now := a.now()
+	inv := &Invitation{
+		Id:      uid,
+		Email:   o.Email,
+		Admin:   o.Admin,
+		Trust:   o.Trust,
+		Creator: o.Creator,
+		Created: now,
+		Expires: now.Add(ttl),
+		Status:  InvitationPending,
+
+		MaxRedemptions: o.MaxRedemptions,
+	}
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		if check != nil {
+			err := check(tx)
+			if err != nil {
+				return err
+			}
+		}
+		if o.MaxRedemptions == 0 {
+			u := &User{Uuid: uid, Email: o.Email, Admin: o.Admin, Trust: o.Trust,
+				InvitationId: uid, InvitedBy: o.Creator, a: a}
+			err := putUser(tx, u)
+			if err != nil {
+				return err
+			}
+		}
+		return putInvitation(tx, inv)
+	})
 	if err != nil {
 		return nil, "", err
 	}
-	inviteText, err := encode(u)
+	inviteText, err := a.invitationToken(uid)
 	if err != nil {
 		return nil, "", err
 	}
-	return u, inviteText, nil
+	return inv, inviteText, nil
+}
+
+// invitationToken mints a token for an invitation. Tokens only carry the
+// id, so a fresh one works as well as the original.
+func (a *Authenticator) invitationToken(id string) (string, error) {
+	return a.encode(&inviteClaims{Kind: "invite", Id: id})
+}
+
+func putInvitation(tx *bolt.Tx, inv *Invitation) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(inv)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("invitations")).Put([]byte(inv.Id), buf.Bytes())
+}
+
+func decodeInvitation(bits []byte) (*Invitation, error) {
+	inv := &Invitation{}
+	err := gob.NewDecoder(bytes.NewReader(bits)).Decode(inv)
+	return inv, err
+}
+
+func (a *Authenticator) Invitation(id string) (*Invitation, error) {
+	bits := a.dbget("invitations", id)
+	if bits == nil {
+		return nil, errors.New("no invitation")
+	}
+	return decodeInvitation(bits)
+}
+
+// invitationFromToken finds the invitation a token refers to, whatever its
+// status.
+func (a *Authenticator) invitationFromToken(token string) (*Invitation, error) {
+	bits := a.decode(token)
+	c := &inviteClaims{}
+	if bits == nil || json.Unmarshal(bits, c) != nil {
+		return nil, errors.New("invalid invitation")
+	}
+	id := c.Id
+	if c.Kind != "invite" {
+		id = c.LegacyUuid
+	}
+	if id == "" {
+		return nil, errors.New("invalid invitation")
+	}
+	return a.Invitation(id)
+}
+
+func (a *Authenticator) invitations(match func(inv *Invitation) bool) ([]*Invitation, error) {
+	var found []*Invitation
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("invitations")).ForEach(func(k, v []byte) error {
+			inv, err := decodeInvitation(v)
+			if err != nil {
+				return err
+			}
+			if match(inv) {
+				found = append(found, inv)
+			}
+			return nil
+		})
+	})
+	return found, err
+}
+
+// ListPendingInvitations returns the invitations that can still be
+// accepted, oldest first.
+func (a *Authenticator) ListPendingInvitations() ([]*Invitation, error) {
+	now := a.now()
+	pending, err := a.invitations(func(inv *Invitation) bool {
+		return inv.Status == InvitationPending && now.Before(inv.Expires)
+	})
+	sort.Sort(byCreation(pending))
+	return pending, err
+}
+
+type byCreation []*Invitation
+
+func (s byCreation) Len() int           { return len(s) }
+func (s byCreation) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
+func (s byCreation) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func ListPendingInvitations() ([]*Invitation, error) {
+	return defaultAuth.ListPendingInvitations()
+}
+
+// closeInvitation marks a pending invitation revoked or expired and deletes
+// its placeholder user.
+func (a *Authenticator) closeInvitation(tx *bolt.Tx, inv *Invitation, status string) error {
+	inv.Status = status
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(inv)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte("invitations")).Put([]byte(inv.Id), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	users := tx.Bucket([]byte("users"))
+	if bits := users.Get([]byte(inv.Id)); bits != nil {
+		u := a.deserializeUser(bits)
+		if u != nil && u.EncryptedPassword == "" {
+			err = users.Delete([]byte(inv.Id))
+		}
+	}
+	return err
+}
+
+// redeemGroupInvitation creates an account from a group invitation, the
+// cap is checked in the same transaction the account is created in.
+func (a *Authenticator) redeemGroupInvitation(id, userName, pw string) (*User, error) {
+	uid, err := seqUid()
+	if err != nil {
+		return nil, err
+	}
+	u := &User{Uuid: uid, UniqueName: userName, Active: true, InvitationId: id, a: a}
+	err = u.CreatePasswordHash(pw)
+	if err != nil {
+		return nil, err
+	}
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		invitations := tx.Bucket([]byte("invitations"))
+		inv, err := decodeInvitation(invitations.Get([]byte(id)))
+		if err != nil {
+			return err
+		}
+		if inv.Status != InvitationPending || !a.now().Before(inv.Expires) {
+			return errors.New("invitation " + inv.Status)
+		}
+		if len(inv.Redemptions) >= inv.MaxRedemptions {
+			return errors.New("invitation fully redeemed")
+		}
+		if tx.Bucket([]byte("user-name")).Get([]byte(userName)) != nil {
+			return errors.New("name taken")
+		}
+		u.Email = inv.Email
+		u.Admin = inv.Admin
+		u.Trust = inv.Trust
+		u.InvitedBy = inv.Creator
+		err = putUser(tx, u)
+		if err != nil {
+			return err
+		}
+		inv.Redemptions = append(inv.Redemptions, uid)
+		if len(inv.Redemptions) == inv.MaxRedemptions {
+			inv.Status = InvitationAccepted
+			inv.AcceptedAt = a.now()
+		}
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(inv)
+		if err != nil {
+			return err
+		}
+		return invitations.Put([]byte(id), buf.Bytes())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (a *Authenticator) RevokeInvitation(id string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bits := tx.Bucket([]byte("invitations")).Get([]byte(id))
+		if bits == nil {
+			return errors.New("no invitation")
+		}
+		inv, err := decodeInvitation(bits)
+		if err != nil {
+			return err
+		}
+		if inv.Status != InvitationPending {
+			return errors.New("invitation already " + inv.Status)
+		}
+		return a.closeInvitation(tx, inv, InvitationRevoked)
+	})
+}
+
+func RevokeInvitation(id string) error {
+	return defaultAuth.RevokeInvitation(id)
+}
+
+// ExpireInvitations closes pending invitations past their expiry, it's run
+// hourly in the background along with ExpireSessions and
+// ExpirePasswordResets.
+func (a *Authenticator) ExpireInvitations() (int, error) {
+	now := a.now()
+	expired, err := a.invitations(func(inv *Invitation) bool {
+		return inv.Status == InvitationPending && !now.Before(inv.Expires)
+	})
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		for _, inv := range expired {
+			err := a.closeInvitation(tx, inv, InvitationExpired)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+func (a *Authenticator) sweep(stop chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		_, err := a.ExpireInvitations()
+		if err != nil {
+			log.Println("expiring invitations failed:", err)
+		}
+		_, err = a.ExpireSessions()
+		if err != nil {
+			log.Println("expiring sessions failed:", err)
+		}
+		_, err = a.ExpirePasswordResets()
+		if err != nil {
+			log.Println("expiring password resets failed:", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Placeholder users from before invitations were tracked get a record
+// so their tokens keep working until the keys expire them.
+func (a *Authenticator) migrateInvitations(tx *bolt.Tx) error {
+	meta := tx.Bucket([]byte("meta"))
+	if meta.Get([]byte("invitations-migrated")) != nil {
+		return nil
+	}
+	invitations := tx.Bucket([]byte("invitations"))
+	now := time.Now()
+	err := tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+		u := a.deserializeUser(v)
+		if u == nil || u.EncryptedPassword != "" || invitations.Get(k) != nil {
+			return nil
+		}
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(&Invitation{
+			Id:      u.Uuid,
+			Email:   u.Email,
+			Admin:   u.Admin,
+			Trust:   u.Trust,
+			Created: now,
+			Expires: now.Add(a.maxDuration),
+			Status:  InvitationPending,
+		})
+		if err != nil {
+			return err
+		}
+		return invitations.Put(k, buf.Bytes())
+	})
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte("invitations-migrated"), []byte("1"))
 }
 
 func FirstRunInvitation(rootUser string) (*User, string, error) {
+	return defaultAuth.FirstRunInvitation(rootUser)
+}
+
+func (a *Authenticator) FirstRunInvitation(rootUser string) (*User, string, error) {
 	preexisting := true
-	db.View(func(tx *bolt.Tx) error {
+	a.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("users"))
 		c := b.Cursor()
 		u0, _ := c.First()
@@ -44,5 +440,5 @@ func FirstRunInvitation(rootUser string) (*User, string, error) {
 	if rootUser == "" {
 		return nil, "", errors.New("root username must not be empty string")
 	}
-	return NewUserInvitation("admin", true, 1e9)
+	return a.NewUserInvitation("admin", true, 1e9)
 }
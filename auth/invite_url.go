@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the blank border around terminal QR codes, in modules.
+const qrQuietZone = 4
+
+// InvitationURL is the link that accepts an invitation token, made from
+// Opts.PublicURL.
+func (a *Authenticator) InvitationURL(token string) (string, error) {
+	if a.publicURL == "" {
+		return "", errors.New("no public url configured")
+	}
+	u, err := url.Parse(a.publicURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("invite", token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func InvitationURL(token string) (string, error) {
+	return defaultAuth.InvitationURL(token)
+}
+
+// QRCodePNG renders text, usually an InvitationURL, as a QR code image.
+func QRCodePNG(text string) ([]byte, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(), nil
+}
+
+// QRCodeText renders text as a QR code for printing to a terminal, two
+// rows of modules per line. The light modules are the ones drawn, which
+// suits the usual dark terminal background.
+func QRCodeText(text string) (string, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			top, bottom := !code.Black(x, y), !code.Black(x, y+1)
+			switch {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
+
+// InvitationQRHandler shows admins the QR code of a pending invitation's
+// URL, given its id parameter. It's a PNG unless format=text.
+func (a *Authenticator) InvitationQRHandler() http.Handler {
+	return a.Wrap(http.HandlerFunc(a.serveInvitationQR), &Rule{Admin: true})
+}
+
+func InvitationQRHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultAuth.InvitationQRHandler().ServeHTTP(w, r)
+	})
+}
+
+func (a *Authenticator) serveInvitationQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inv, err := a.Invitation(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "no invitation", http.StatusNotFound)
+		return
+	}
+	if inv.Status != InvitationPending {
+		http.Error(w, "invitation "+inv.Status, http.StatusGone)
+		return
+	}
+	token, err := a.invitationToken(inv.Id)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	link, err := a.InvitationURL(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.FormValue("format") == "text" {
+		text, err := QRCodeText(link)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(link + "\n\n" + text))
+		return
+	}
+	png, err := QRCodePNG(link)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
@@ -1,90 +1,216 @@
 package auth
 
 import (
-	"code.google.com/p/go.crypto/bcrypt"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func LoginByName(name, givenPw string) (error, *User) {
-	u := &User{UniqueName: name}
-	u, err := (&u).Load()
-	if err != nil || u == nil {
+	return defaultAuth.LoginByName(name, givenPw)
+}
+
+// LoginByName checks a password, failures count towards the username's
+// lockout. While locked out the error is a *LockoutError. It knows nothing
+// of second factors, callers should check HasTOTP on the user.
+func (a *Authenticator) LoginByName(name, givenPw string) (error, *User) {
+	return a.login(name, givenPw, "")
+}
+
+// login also counts failures against the client address, if known.
+func (a *Authenticator) login(name, givenPw, addr string) (error, *User) {
+	err := a.reserveAttempt(name, addr)
+	if err != nil {
+		return err, nil
+	}
+	u := &User{UniqueName: name, a: a}
+	u, err = u.Load()
+	if err != nil || u == nil || !u.Active {
+		// unknown and known users take about as long to reject
+		a.checkPassword(a.dummyHash, givenPw)
 		return errors.New("unauthorized"), nil
 	}
-	authed := bcrypt.CompareHashAndPassword([]byte(u.EncryptedPassword), []byte(givenPw))
+	authed := a.checkPassword(u.EncryptedPassword, givenPw)
 	if authed == nil {
+		a.releaseAttempt(name, addr)
+		// the address isn't cleared, or any account would do for resetting
+		// it, and the user only once the second factor is in too
+		if !u.HasTOTP() {
+			a.clearLoginFailures("user:" + name)
+		}
+		if a.needsRehash(u.EncryptedPassword) {
+			a.rehashPassword(u, givenPw)
+		}
 		return authed, u
 	}
 	return authed, nil
 }
 
-func acceptInvite(userName, pw, invitation string) (*User, error) {
-	var u *User
-	takenName := dbget("user-name", userName)
+// rehashPassword upgrades a stored hash made with an older hasher, weaker
+// parameters or without the pepper. The login goes ahead if it fails.
+func (a *Authenticator) rehashPassword(u *User, pw string) {
+	err := u.CreatePasswordHash(pw)
+	if err == nil {
+		err = u.Save()
+	}
+	if err != nil {
+		log.Println("rehashing password failed:", err)
+	}
+}
+
+// refuseLogin shows the login form again with a message.
+func (a *Authenticator) refuseLogin(w http.ResponseWriter, r *http.Request, message string) {
+	token, err := a.setLoginCSRF(w, r)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, mkHtml(renderLoginForm(token, message)))
+}
+
+func (a *Authenticator) acceptInvite(userName, pw, invitation string) (*User, error) {
+	takenName := a.dbget("user-name", userName)
 	if takenName != nil {
 		return nil, errors.New("name taken")
 	}
-	userBits := decode(invitation)
-	if userBits != nil && pw != "" {
-		err := json.Unmarshal(userBits, &u)
-		if err != nil {
-			return nil, err
+	inv, err := a.invitationFromToken(invitation)
+	if err == nil && pw != "" {
+		if inv.Status == InvitationAccepted {
+			return nil, errors.New("previously accepted invitation")
 		}
-		u, err = u.Load()
+		if inv.Status != InvitationPending || !a.now().Before(inv.Expires) {
+			return nil, errors.New("invitation " + InvitationExpired)
+		}
+		err = a.CheckPassword(userName, pw)
 		if err != nil {
 			return nil, err
 		}
-		if u.EncryptedPassword != "" {
-			return nil, errors.New("previously accepted invitation")
+		if inv.MaxRedemptions > 0 {
+			return a.redeemGroupInvitation(inv.Id, userName, pw)
 		}
-		pwHash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+		return a.redeemInvitation(inv.Id, userName, pw)
+	}
+	return nil, errors.New("invalid invitation")
+}
+
+// redeemInvitation turns a single use invitation's placeholder into an
+// account, checking it's still pending in the same transaction so that
+// only one of several concurrent acceptances wins.
+func (a *Authenticator) redeemInvitation(id, userName, pw string) (*User, error) {
+	hashed := &User{Uuid: id, a: a}
+	err := hashed.CreatePasswordHash(pw)
+	if err != nil {
+		return nil, err
+	}
+	var u *User
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		invitations := tx.Bucket([]byte("invitations"))
+		inv, err := decodeInvitation(invitations.Get([]byte(id)))
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if inv.Status == InvitationAccepted {
+			return errors.New("previously accepted invitation")
 		}
+		if inv.Status != InvitationPending || !a.now().Before(inv.Expires) {
+			return errors.New("invitation " + InvitationExpired)
+		}
+		if tx.Bucket([]byte("user-name")).Get([]byte(userName)) != nil {
+			return errors.New("name taken")
+		}
+		bits := tx.Bucket([]byte("users")).Get([]byte(id))
+		if bits == nil {
+			return errors.New("invalid invitation")
+		}
+		u = a.deserializeUser(bits)
+		if u == nil {
+			return errors.New("unlikely deserialization error")
+		}
+		if u.EncryptedPassword != "" {
+			return errors.New("previously accepted invitation")
+		}
+		u.EncryptedPassword = hashed.EncryptedPassword
 		u.UniqueName = userName
-		u.EncryptedPassword = string(pwHash)
-		err = u.Save()
+		u.Active = true
+		u.InvitationId = id
+		err = putUser(tx, u)
 		if err != nil {
-			return nil, err
-		} else {
-			return u, nil
+			return err
 		}
+		inv.Status = InvitationAccepted
+		inv.AcceptedAt = a.now()
+		return putInvitation(tx, inv)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("invalid invitation")
+	a.authz.forget(id)
+	return u, nil
 }
 
 func Login(w http.ResponseWriter, r *http.Request) {
+	defaultAuth.Login(w, r)
+}
+
+func (a *Authenticator) Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		fmt.Fprintf(w, mkHtml(LoginForm))
+		token, err := a.setLoginCSRF(w, r)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, mkHtml(renderLoginForm(token, "")))
 		return
 	}
 
 	if r.Method == "POST" {
+		if !a.checkLoginCSRF(r) {
+			http.Error(w, "invalid csrf token, reload the login page", http.StatusForbidden)
+			return
+		}
 		userName := r.FormValue("username")
 		pw := r.FormValue("password")
 		invitation := r.FormValue("invite")
 		var u *User
 		var err error
 		if invitation != "" {
-			u, err = acceptInvite(userName, pw, invitation)
+			u, err = a.acceptInvite(userName, pw, invitation)
+			if perr, ok := err.(*PasswordError); ok {
+				a.refuseLogin(w, r, perr.Reason)
+				return
+			}
 			if err != nil {
 				http.Error(w, "invitation error", http.StatusUnauthorized)
 				return
 			}
-			u.setSession(w)
+			u.setSession(w, r, false)
 			http.Redirect(w, r, r.URL.Path, 302)
 			return
 		}
 
-		err, u = LoginByName(userName, pw)
+		if r.FormValue("totp_pending") != "" {
+			a.finishSecondFactor(w, r)
+			return
+		}
+
+		err, u = a.login(userName, pw, clientAddr(r.RemoteAddr))
+		if a.writeLockout(w, err) {
+			return
+		}
 		if err != nil {
 			http.Error(w, "invalid username/password", http.StatusUnauthorized)
 			return
 		}
-		err = u.setSession(w)
+		if u.HasTOTP() {
+			a.promptSecondFactor(w, r, u)
+			return
+		}
+		err = u.setSession(w, r, false)
 		if err != nil {
 			http.Error(w, "server error", http.StatusInternalServerError)
 			return
@@ -94,3 +220,15 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// writeLockout answers with 429 if err is a *LockoutError.
+func (a *Authenticator) writeLockout(w http.ResponseWriter, err error) bool {
+	lockout, ok := err.(*LockoutError)
+	if !ok {
+		return false
+	}
+	retry := lockout.Until.Sub(a.now())/time.Second + 1
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry)))
+	http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+	return true
+}
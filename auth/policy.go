@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// bcrypt ignores anything past 72 bytes of password.
+const defaultMaxPasswordLength = 72
+
+// A PasswordError explains why a new password was refused, it's meant
+// for the person choosing it.
+type PasswordError struct {
+	Reason string
+}
+
+func (e *PasswordError) Error() string {
+	return e.Reason
+}
+
+// CheckPassword applies the realm's password policy to a password being
+// set for the account named name, returning a *PasswordError if it's
+// refused.
+func (a *Authenticator) CheckPassword(name, password string) error {
+	if password == "" {
+		return &PasswordError{"password must not be empty"}
+	}
+	if utf8.RuneCountInString(password) < a.minPasswordLength {
+		return &PasswordError{"password is too short"}
+	}
+	if len(password) > a.maxPasswordLength {
+		return &PasswordError{"password is too long"}
+	}
+	if a.noNameInPassword && name != "" &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(name)) {
+		return &PasswordError{"password must not contain your user name"}
+	}
+	if a.breachedPasswords != "" {
+		found, err := breached(a.breachedPasswords, password)
+		if err != nil {
+			// a missing list shouldn't stop anyone setting a password
+			log.Println("checking breached passwords failed:", err)
+		} else if found {
+			return &PasswordError{"password is known from a data breach, choose another"}
+		}
+	}
+	return nil
+}
+
+func CheckPassword(name, password string) error {
+	return defaultAuth.CheckPassword(name, password)
+}
+
+// ChangePassword sets a new password after checking the current one and
+// the password policy.
+func (u *User) ChangePassword(current, password string) error {
+	a := u.authenticator()
+	stored, err := u.Load()
+	if err != nil || stored == nil {
+		return errors.New("no user")
+	}
+	if a.checkPassword(stored.EncryptedPassword, current) != nil {
+		return errors.New("current password is wrong")
+	}
+	err = a.CheckPassword(stored.UniqueName, password)
+	if err != nil {
+		return err
+	}
+	err = stored.CreatePasswordHash(password)
+	if err != nil {
+		return err
+	}
+	err = stored.Save()
+	if err != nil {
+		return err
+	}
+	u.EncryptedPassword = stored.EncryptedPassword
+	return nil
+}
+
+// breached looks a password up in a file of SHA-1 hashes in hex, sorted
+// and one per line, such as the "ordered by hash" Pwned Passwords list.
+// Anything after a colon on a line is ignored, and lines may hold just a
+// prefix of the hash. The file is binary searched in place.
+func breached(path, password string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineFrom(f, mid, info.Size())
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		entry := strings.ToUpper(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+		key := hash
+		if len(entry) < len(key) {
+			key = key[:len(entry)]
+		}
+		switch {
+		case entry == "":
+			lo = start + int64(len(line)) + 1
+		case key == entry:
+			return true, nil
+		case entry < key:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineFrom finds the first line starting at or after offset, returning
+// where it starts and its text without the newline.
+func lineFrom(f *os.File, offset, size int64) (int64, string, error) {
+	start := offset
+	if offset > 0 {
+		start--
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+	if offset > 0 {
+		skipped, err := r.ReadString('\n')
+		if err == io.EOF {
+			return size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	return start, strings.TrimSuffix(line, "\n"), nil
+}
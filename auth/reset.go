@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resetClaims is the content of a reset token, Nonce is recorded in the
+// password-resets bucket and deleted when used so each token works once.
+// The record is the user's Uuid and, after a space, when it was made.
+type resetClaims struct {
+	Kind     string `json:"k"`
+	UserUuid string `json:"r"`
+	Nonce    string `json:"n"`
+}
+
+// NewPasswordReset returns a token that lets whoever holds it set a new
+// password for u within Opts.PasswordResetTTL. Admins hand it over however
+// they like, e.g. as a link to the ResetPassword handler with ?reset=token.
+func (a *Authenticator) NewPasswordReset(u *User) (string, error) {
+	if u.Uuid == "" || a.dbget("users", u.Uuid) == nil {
+		return "", errors.New("no user")
+	}
+	nonce, err := newSessionId()
+	if err != nil {
+		return "", err
+	}
+	err = a.dbput("password-resets", nonce, []byte(u.Uuid+" "+strconv.FormatInt(a.now().Unix(), 10)))
+	if err != nil {
+		return "", err
+	}
+	return a.encode(&resetClaims{Kind: "reset", UserUuid: u.Uuid, Nonce: nonce})
+}
+
+func NewPasswordReset(u *User) (string, error) {
+	return defaultAuth.NewPasswordReset(u)
+}
+
+// RequestPasswordReset is the self-service variant, send is expected to get
+// the token to the user out of band (email, chat, ...). Unknown and
+// inactive names are silently ignored so they can't be probed for.
+func (a *Authenticator) RequestPasswordReset(name string, send func(u *User, token string) error) error {
+	u, err := (&User{UniqueName: name, a: a}).Load()
+	if err != nil || u == nil || !u.Active {
+		return nil
+	}
+	token, err := a.NewPasswordReset(u)
+	if err != nil {
+		return err
+	}
+	return send(u, token)
+}
+
+func RequestPasswordReset(name string, send func(u *User, token string) error) error {
+	return defaultAuth.RequestPasswordReset(name, send)
+}
+
+// CompletePasswordReset sets a new password on the token's account, ends
+// its sessions and clears any lockout.
+func (a *Authenticator) CompletePasswordReset(token, newPassword string) (*User, error) {
+	msg := a.decodeWithin(token, a.passwordResetTTL)
+	c := &resetClaims{}
+	if msg == nil || json.Unmarshal(msg, c) != nil || c.Kind != "reset" || c.Nonce == "" {
+		return nil, errors.New("invalid or expired reset token")
+	}
+	u, err := (&User{Uuid: c.UserUuid, a: a}).Load()
+	if err != nil || u == nil {
+		return nil, errors.New("no user")
+	}
+	// refused passwords leave the token usable for another try
+	err = a.CheckPassword(u.UniqueName, newPassword)
+	if err != nil {
+		return nil, err
+	}
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("password-resets"))
+		userUuid, created := parseResetRecord(b.Get([]byte(c.Nonce)))
+		if userUuid != c.UserUuid {
+			return errors.New("reset token already used")
+		}
+		if a.now().Sub(created) > a.passwordResetTTL {
+			return errors.New("invalid or expired reset token")
+		}
+		return b.Delete([]byte(c.Nonce))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = u.CreatePasswordHash(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	err = u.Save()
+	if err != nil {
+		return nil, err
+	}
+	a.RevokeUserSessions(u.Uuid)
+	a.ClearUserLockout(u.UniqueName)
+	return u, nil
+}
+
+func CompletePasswordReset(token, newPassword string) (*User, error) {
+	return defaultAuth.CompletePasswordReset(token, newPassword)
+}
+
+// parseResetRecord splits a password-resets record, unreadable ones have
+// no user and a zero time.
+func parseResetRecord(v []byte) (string, time.Time) {
+	parts := strings.SplitN(string(v), " ", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}
+	}
+	secs, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return parts[0], time.Unix(secs, 0)
+}
+
+// ExpirePasswordResets deletes the records of reset tokens too old to be
+// used, whether or not they were. It's run hourly in the background.
+func (a *Authenticator) ExpirePasswordResets() (int, error) {
+	now := a.now()
+	n := 0
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("password-resets"))
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if _, created := parseResetRecord(v); now.Sub(created) > a.passwordResetTTL {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+func ExpirePasswordResets() (int, error) {
+	return defaultAuth.ExpirePasswordResets()
+}
+
+// ResetPassword serves the reset form for GET ?reset=token and sets the
+// new password on POST.
+func (a *Authenticator) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fmt.Fprint(w, mkHtml(renderResetForm(r.FormValue("reset"), "")))
+	case "POST":
+		pw := r.FormValue("password")
+		if pw != r.FormValue("confirm") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, mkHtml(renderResetForm(r.FormValue("reset"), "passwords don't match")))
+			return
+		}
+		_, err := a.CompletePasswordReset(r.FormValue("reset"), pw)
+		if perr, ok := err.(*PasswordError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, mkHtml(renderResetForm(r.FormValue("reset"), perr.Reason)))
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, mkHtml("Password changed, you can now log in."))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func renderResetForm(token, message string) string {
+	form := strings.Replace(ResetForm, "{{error}}", html.EscapeString(message), 1)
+	return strings.Replace(form, "{{reset}}", html.EscapeString(token), 1)
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	defaultAuth.ResetPassword(w, r)
+}
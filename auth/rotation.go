@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+func (a *Authenticator) rotationPeriod() time.Duration {
+	return time.Duration(a.keyRotationInterval * float64(time.Hour))
+}
+
+// lastRotationTime is read from disk so that restarting the server doesn't
+// restart the rotation clock.
+func (a *Authenticator) lastRotationTime() (time.Time, error) {
+	bits, err := ioutil.ReadFile(a.rotationTimeFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(bits)))
+}
+
+func (a *Authenticator) persistRotationTime(t time.Time) error {
+	return ioutil.WriteFile(a.rotationTimeFile, []byte(t.UTC().Format(time.RFC3339Nano)), 0644)
+}
+
+// background runs f in a goroutine that Stop signals and waits for.
+func (a *Authenticator) background(f func(stop chan struct{})) {
+	if a.stop == nil {
+		a.stop = make(chan struct{})
+	}
+	a.running.Add(1)
+	go func() {
+		defer a.running.Done()
+		f(a.stop)
+	}()
+}
+
+// rotateIfDue rotates the keys once a period has passed since they last
+// were, and returns how long until they're next due.
+func (a *Authenticator) rotateIfDue() time.Duration {
+	period := a.rotationPeriod()
+	last, err := a.lastRotationTime()
+	if err == nil && a.now().Before(last.Add(period)) {
+		return last.Add(period).Sub(a.now())
+	}
+	err = a.RotateActiveKeys()
+	if err != nil {
+		log.Println("key rotation failed:", err)
+		// don't spin on a persistent error, try again next period
+		a.persistRotationTime(a.now())
+	}
+	return period
+}
+
+func (a *Authenticator) rotateOnSchedule(stop chan struct{}) {
+	for {
+		timer := time.NewTimer(a.rotateIfDue())
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop ends background key rotation and housekeeping, it is safe to call
+// more than once.
+func (a *Authenticator) Stop() {
+	if a.stop == nil {
+		return
+	}
+	a.stopOnce.Do(func() { close(a.stop) })
+	a.running.Wait()
+}
@@ -4,38 +4,103 @@ import (
 	"net/http"
 )
 
+// A Rule is the basic Authorizer: admins are always admitted, others by
+// trust and groups.
 type Rule struct {
 	Admin        bool
 	TrustExactly int
 	Trust        int
 	Redirect     string
+	// CSRF requires non-GET/HEAD/OPTIONS requests to carry the session's
+	// CSRFToken or a same-origin Origin header.
+	CSRF bool
+	// SecondFactor only admits sessions that were logged into with a TOTP
+	// or recovery code, admins included.
+	SecondFactor bool
+	// AnyGroup admits members of any of the groups, AllGroups only members
+	// of all of them. Either is required on top of Trust or TrustExactly if
+	// those are set, and on its own otherwise. Admins are always admitted.
+	AnyGroup  []string
+	AllGroups []string
+	// BasicAuth is for clients that can't use the login form: requests
+	// without a session are answered with a Basic challenge and their
+	// credentials checked on every request, without creating a session.
+	BasicAuth bool
 }
 
-var loginHandler *http.ServeMux
+func Wrap(h http.Handler, az Authorizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultAuth.Wrap(h, az).ServeHTTP(w, r)
+	})
+}
 
-func Wrap(h http.Handler, rule *Rule) http.Handler {
-	if loginHandler == nil {
-		loginHandler = http.NewServeMux()
-		loginHandler.Handle("/", http.HandlerFunc(Login))
-	}
+// Wrap serves requests az admits with h, and shows the rest the login
+// form, or whatever the Rule az picks for the request says.
+func (a *Authenticator) Wrap(h http.Handler, az Authorizer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		u := getSession(r)
-		if u.Admin {
-			h.ServeHTTP(w, r)
+		opts := optsOf(az, r)
+		c := a.currentClaims(r)
+		if c == nil && opts.basicAuth {
+			if name, pw, ok := r.BasicAuth(); ok {
+				var err error
+				c, err = a.basicClaims(r, name, pw)
+				if err != nil {
+					a.challenge(w, err)
+					return
+				}
+				r = withBasicClaims(r, c)
+			}
+		}
+		if c != nil && c.scope != nil && !c.scope.permits(r) {
+			http.Error(w, "outside the api token's scope", http.StatusForbidden)
 			return
 		}
-		if rule.TrustExactly == u.Trust && rule.TrustExactly != 0 {
+		if az.Authorize(c.subject(), r) {
+			if opts.csrf && !checkCSRF(r, c) {
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
 			h.ServeHTTP(w, r)
 			return
 		}
-		if u.Trust >= 1 && rule.Trust >= 1 && u.Trust >= rule.Trust {
-			h.ServeHTTP(w, r)
+		if opts.basicAuth && c == nil {
+			a.challenge(w, nil)
 			return
 		}
-		if rule.Redirect != "" {
-			http.Redirect(w, r, rule.Redirect, 302)
+		if c != nil && c.basic {
+			http.Error(w, "forbidden", http.StatusForbidden)
 			return
 		}
-		loginHandler.ServeHTTP(w, r)
+		if opts.redirect != "" {
+			http.Redirect(w, r, opts.redirect, 302)
+			return
+		}
+		a.loginHandler.ServeHTTP(w, r)
 	})
 }
+
+func (rule *Rule) Authorize(u *Subject, r *http.Request) bool {
+	if rule.SecondFactor && !u.SecondFactor {
+		return false
+	}
+	if u.Admin {
+		return true
+	}
+	if !rule.inGroups(u) {
+		return false
+	}
+	if rule.Trust == 0 && rule.TrustExactly == 0 {
+		return u.UserUuid != "" && len(rule.AnyGroup)+len(rule.AllGroups) > 0
+	}
+	if rule.TrustExactly == u.Trust && rule.TrustExactly != 0 && !u.TrustCapped {
+		return true
+	}
+	if u.Trust >= 1 && rule.Trust >= 1 && u.Trust >= rule.Trust {
+		return true
+	}
+	return false
+}
+
+func (rule *Rule) wrapOpts(r *http.Request) wrapOpts {
+	return wrapOpts{csrf: rule.CSRF, redirect: rule.Redirect, basicAuth: rule.BasicAuth}
+}
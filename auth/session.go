@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"github.com/boltdb/bolt"
+	"net/http"
+	"time"
+)
+
+// A Session is the server side record of a login. The cookie only points at
+// it, deleting the record logs the holder of the cookie out.
+type Session struct {
+	Id           string
+	UserUuid     string
+	Created      time.Time
+	SecondFactor bool
+}
+
+func newSessionId() (string, error) {
+	bits := make([]byte, 16)
+	_, err := rand.Read(bits)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bits), nil
+}
+
+// Sessions are kept in a bucket per user inside the sessions bucket, keyed
+// by session id.
+func (a *Authenticator) createSession(u *User, secondFactor bool) (*Session, error) {
+	if u.Uuid == "" {
+		return nil, errors.New("uninitialized")
+	}
+	sid, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{Id: sid, UserUuid: u.Uuid, Created: time.Now(), SecondFactor: secondFactor}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(s)
+	if err != nil {
+		return nil, err
+	}
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte("sessions")).CreateBucketIfNotExists([]byte(u.Uuid))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(sid), buf.Bytes())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (a *Authenticator) sessionExists(userUuid, sid string) bool {
+	found := false
+	a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions")).Bucket([]byte(userUuid))
+		if b != nil && b.Get([]byte(sid)) != nil {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+func (a *Authenticator) Sessions(userUuid string) ([]*Session, error) {
+	var sessions []*Session
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions")).Bucket([]byte(userUuid))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s := &Session{}
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(s)
+			if err != nil {
+				return err
+			}
+			sessions = append(sessions, s)
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func (a *Authenticator) RevokeSession(userUuid, sid string) error {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sessions")).Bucket([]byte(userUuid))
+		if b == nil || b.Get([]byte(sid)) == nil {
+			return errors.New("no session")
+		}
+		return b.Delete([]byte(sid))
+	})
+	if err != nil {
+		return err
+	}
+	// only once committed, or a concurrent check could cache the old state
+	a.authz.forget(userUuid)
+	return nil
+}
+
+// RevokeUserSessions logs a user out everywhere.
+func (a *Authenticator) RevokeUserSessions(userUuid string) error {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket([]byte("sessions"))
+		if sessions.Bucket([]byte(userUuid)) == nil {
+			return nil
+		}
+		return sessions.DeleteBucket([]byte(userUuid))
+	})
+	if err != nil {
+		return err
+	}
+	a.authz.forget(userUuid)
+	return nil
+}
+
+// ExpireSessions deletes the records of sessions older than the keys last,
+// whose cookies can't be decrypted any more, it's run hourly in the
+// background.
+func (a *Authenticator) ExpireSessions() (int, error) {
+	cutoff := time.Now().Add(-a.maxDuration)
+	n := 0
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket([]byte("sessions"))
+		var users [][]byte
+		err := sessions.ForEach(func(k, v []byte) error {
+			if v == nil {
+				users = append(users, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, userUuid := range users {
+			b := sessions.Bucket(userUuid)
+			var expired [][]byte
+			total := 0
+			err = b.ForEach(func(k, v []byte) error {
+				total++
+				s := &Session{}
+				if gob.NewDecoder(bytes.NewReader(v)).Decode(s) != nil || s.Created.Before(cutoff) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, sid := range expired {
+				err = b.Delete(sid)
+				if err != nil {
+					return err
+				}
+			}
+			n += len(expired)
+			if len(expired) == total {
+				err = sessions.DeleteBucket(userUuid)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func ExpireSessions() (int, error) {
+	return defaultAuth.ExpireSessions()
+}
+
+func Sessions(userUuid string) ([]*Session, error) {
+	return defaultAuth.Sessions(userUuid)
+}
+
+func RevokeSession(userUuid, sid string) error {
+	return defaultAuth.RevokeSession(userUuid, sid)
+}
+
+func RevokeUserSessions(userUuid string) error {
+	return defaultAuth.RevokeUserSessions(userUuid)
+}
+
+// Logout ends the session the request was made with and clears the cookie.
+func (a *Authenticator) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := a.readClaims(r)
+	if c != nil {
+		a.RevokeSession(c.UserUuid, c.Session)
+	}
+	a.clearCookie(w, r)
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	defaultAuth.Logout(w, r)
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"net"
+	"time"
+)
+
+// freeLoginFailures may be made before backoff kicks in, enough for a few
+// typos.
+const freeLoginFailures = 3
+
+// loginFailures is kept per username ("user:" keys) and per client address
+// ("addr:" keys) in the login-failures bucket.
+type loginFailures struct {
+	Count int
+	Last  time.Time
+}
+
+// A LockoutError is returned instead of checking a password while the
+// username or the client address is backing off.
+type LockoutError struct {
+	Until time.Time
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again after %v", e.Until.Format(time.RFC3339))
+}
+
+// blockedUntil is when another attempt may be made after f, counting starts
+// over once the lockout period has passed since the last failure.
+func (a *Authenticator) blockedUntil(f *loginFailures) time.Time {
+	if f.Count >= a.maxLoginFailures {
+		return f.Last.Add(a.loginLockout)
+	}
+	if f.Count < freeLoginFailures {
+		return time.Time{}
+	}
+	delay := a.loginBackoff << uint(f.Count-freeLoginFailures)
+	if delay > a.loginLockout || delay <= 0 {
+		delay = a.loginLockout
+	}
+	return f.Last.Add(delay)
+}
+
+func failureKeys(name, addr string) []string {
+	keys := []string{"user:" + name}
+	if addr != "" {
+		keys = append(keys, "addr:"+addr)
+	}
+	return keys
+}
+
+// clientAddr is the host part of RemoteAddr, there's no trusting of
+// X-Forwarded-For here.
+func clientAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func (a *Authenticator) readFailures(b *bolt.Bucket, key string) *loginFailures {
+	f := &loginFailures{}
+	bits := b.Get([]byte(key))
+	if bits == nil {
+		return f
+	}
+	if gob.NewDecoder(bytes.NewReader(bits)).Decode(f) != nil {
+		return &loginFailures{}
+	}
+	if a.now().Sub(f.Last) > a.loginLockout {
+		return &loginFailures{}
+	}
+	return f
+}
+
+func putFailures(b *bolt.Bucket, key string, f *loginFailures) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(f)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), buf.Bytes())
+}
+
+// reserveAttempt checks for a lockout and counts the attempt as a failure
+// in the same transaction, before any password or code is compared, so
+// parallel guesses can't all get in ahead of the first being recorded.
+// Attempts that succeed are handed back with releaseAttempt.
+func (a *Authenticator) reserveAttempt(name, addr string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("login-failures"))
+		now := a.now()
+		keys := failureKeys(name, addr)
+		failures := make([]*loginFailures, len(keys))
+		var until time.Time
+		for i, k := range keys {
+			failures[i] = a.readFailures(b, k)
+			t := a.blockedUntil(failures[i])
+			if t.After(until) {
+				until = t
+			}
+		}
+		if until.After(now) {
+			return &LockoutError{Until: until}
+		}
+		for i, k := range keys {
+			failures[i].Count++
+			failures[i].Last = now
+			err := putFailures(b, k, failures[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// releaseAttempt uncounts an attempt reserveAttempt counted.
+func (a *Authenticator) releaseAttempt(name, addr string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("login-failures"))
+		for _, k := range failureKeys(name, addr) {
+			f := a.readFailures(b, k)
+			if f.Count == 0 {
+				continue
+			}
+			f.Count--
+			err := putFailures(b, k, f)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (a *Authenticator) clearLoginFailures(keys ...string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("login-failures"))
+		for _, k := range keys {
+			err := b.Delete([]byte(k))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ClearUserLockout forgets failed logins for a username.
+func (a *Authenticator) ClearUserLockout(name string) error {
+	return a.clearLoginFailures("user:" + name)
+}
+
+// ClearAddressLockout forgets failed logins from a client IP address.
+func (a *Authenticator) ClearAddressLockout(addr string) error {
+	return a.clearLoginFailures("addr:" + addr)
+}
+
+func ClearUserLockout(name string) error {
+	return defaultAuth.ClearUserLockout(name)
+}
+
+func ClearAddressLockout(addr string) error {
+	return defaultAuth.ClearAddressLockout(addr)
+}
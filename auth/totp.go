@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fernet/fernet-go"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// RFC 6238 with the parameters every authenticator app supports.
+const (
+	totpStep          = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	// secondFactorWindow is how long the code form may be left open after
+	// the password was accepted.
+	secondFactorWindow = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", bin%1000000)
+}
+
+// validTOTP returns the time step that code matches, refusing steps at or
+// before the last one used so a code can't be replayed.
+func validTOTP(secret []byte, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpStep
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Secrets are encrypted with a key of their own that never rotates, so
+// they don't age out with the auth keys.
+func (a *Authenticator) encryptSecret(secret []byte) (string, error) {
+	tok, err := fernet.EncryptAndSign(secret, a.secretKey)
+	return string(tok), err
+}
+
+func (a *Authenticator) decryptSecret(tok string) []byte {
+	return fernet.VerifyAndDecrypt([]byte(tok), 0, []*fernet.Key{a.secretKey})
+}
+
+// loadSecretKey reads the secret key, making one on first run.
+func (a *Authenticator) loadSecretKey() (*fernet.Key, error) {
+	encoded, err := ioutil.ReadFile(a.secretKeyFile)
+	if err == nil {
+		return fernet.DecodeKey(strings.TrimSpace(string(encoded)))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	k := &fernet.Key{}
+	err = k.Generate()
+	if err != nil {
+		return nil, err
+	}
+	return k, ioutil.WriteFile(a.secretKeyFile, []byte(k.Encode()), 0600)
+}
+
+func (u *User) HasTOTP() bool {
+	return u.TOTPSecret != ""
+}
+
+// EnrollTOTP starts two factor enrollment, returning the secret and an
+// otpauth:// URI for authenticator apps. It only takes effect once a code
+// from the app is given to ConfirmTOTP.
+func (u *User) EnrollTOTP() (secret, uri string, err error) {
+	a := u.authenticator()
+	bits := make([]byte, 20)
+	_, err = rand.Read(bits)
+	if err != nil {
+		return "", "", err
+	}
+	u.TOTPPending, err = a.encryptSecret(bits)
+	if err != nil {
+		return "", "", err
+	}
+	err = u.Save()
+	if err != nil {
+		return "", "", err
+	}
+	secret = totpEncoding.EncodeToString(bits)
+	label := defaultDir + ":" + u.UniqueName
+	q := url.Values{"secret": {secret}, "issuer": {defaultDir}}
+	uri = "otpauth://totp/" + url.PathEscape(label) + "?" + q.Encode()
+	return secret, uri, nil
+}
+
+// ConfirmTOTP turns on two factor login if code matches the pending secret,
+// and returns the one-time recovery codes, which aren't retrievable later.
+func (u *User) ConfirmTOTP(code string) ([]string, error) {
+	a := u.authenticator()
+	if u.TOTPPending == "" {
+		return nil, errors.New("no pending enrollment")
+	}
+	secret := a.decryptSecret(u.TOTPPending)
+	if secret == nil {
+		return nil, errors.New("pending enrollment unreadable, enroll again")
+	}
+	step, ok := validTOTP(secret, code, 0, time.Now())
+	if !ok {
+		return nil, errors.New("invalid code")
+	}
+	codes, err := u.resetRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	u.TOTPSecret = u.TOTPPending
+	u.TOTPPending = ""
+	u.TOTPLastStep = step
+	err = u.Save()
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (u *User) DisableTOTP() error {
+	u.TOTPSecret = ""
+	u.TOTPPending = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+	return u.Save()
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(code, "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// resetRecoveryCodes replaces the user's recovery codes, only their hashes
+// are kept. The caller saves.
+func (u *User) resetRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		bits := make([]byte, 5)
+		_, err := rand.Read(bits)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(bits))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	u.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// NewRecoveryCodes invalidates any remaining recovery codes and issues a
+// fresh set.
+func (u *User) NewRecoveryCodes() ([]string, error) {
+	if !u.HasTOTP() {
+		return nil, errors.New("two factor login not enabled")
+	}
+	codes, err := u.resetRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	return codes, u.Save()
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code,
+// saving the user to burn whichever was used.
+func (u *User) checkSecondFactor(code string) bool {
+	secret := u.authenticator().decryptSecret(u.TOTPSecret)
+	if secret != nil {
+		if step, ok := validTOTP(secret, code, u.TOTPLastStep, time.Now()); ok {
+			u.TOTPLastStep = step
+			return u.Save() == nil
+		}
+	}
+	hashed := hashRecoveryCode(code)
+	for i, h := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hashed)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return u.Save() == nil
+		}
+	}
+	return false
+}
+
+// pendingLogin is handed to the browser between the password and code
+// steps, encrypted like everything else.
+type pendingLogin struct {
+	Kind     string `json:"k"`
+	UserUuid string `json:"p"`
+}
+
+func (a *Authenticator) promptSecondFactor(w http.ResponseWriter, r *http.Request, u *User) {
+	pending, err := a.encode(&pendingLogin{Kind: "totp", UserUuid: u.Uuid})
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	csrf, _ := r.Cookie(a.loginCSRFCookieName())
+	fmt.Fprint(w, mkHtml(renderSecondFactorForm(pending, csrf.Value)))
+}
+
+func (a *Authenticator) finishSecondFactor(w http.ResponseWriter, r *http.Request) {
+	msg := a.decodeWithin(r.FormValue("totp_pending"), secondFactorWindow)
+	p := &pendingLogin{}
+	if msg == nil || json.Unmarshal(msg, p) != nil || p.Kind != "totp" {
+		http.Error(w, "login expired, start over", http.StatusUnauthorized)
+		return
+	}
+	u, err := (&User{Uuid: p.UserUuid, a: a}).Load()
+	if err != nil || u == nil || !u.Active || !u.HasTOTP() {
+		http.Error(w, "login expired, start over", http.StatusUnauthorized)
+		return
+	}
+	addr := clientAddr(r.RemoteAddr)
+	err = a.reserveAttempt(u.UniqueName, addr)
+	if a.writeLockout(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	if !u.checkSecondFactor(r.FormValue("code")) {
+		http.Error(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+	a.releaseAttempt(u.UniqueName, addr)
+	a.clearLoginFailures("user:" + u.UniqueName)
+	err = u.setSession(w, r, true)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+)
+
+// An InviteNode is a user along with the accounts they invited, and
+// the accounts those invited, and so on. Pending invitations aren't
+// accounts yet and don't appear, see ListPendingInvitations.
+type InviteNode struct {
+	User    *User         `json:"user"`
+	Invited []*InviteNode `json:"invited"`
+}
+
+// Size counts the users in the tree, its root included.
+func (t *InviteNode) Size() int {
+	n := 1
+	for _, child := range t.Invited {
+		n += child.Size()
+	}
+	return n
+}
+
+// Users lists the tree's users, each before the ones they invited.
+func (t *InviteNode) Users() []*User {
+	users := []*User{t.User}
+	for _, child := range t.Invited {
+		users = append(users, child.Users()...)
+	}
+	return users
+}
+
+// invitationTree builds the tree rooted at userUuid from the users bucket.
+// Children are in Uuid, and so creation, order.
+func (a *Authenticator) invitationTree(tx *bolt.Tx, userUuid string) (*InviteNode, error) {
+	var root *User
+	invited := make(map[string][]*User)
+	err := tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+		u := a.deserializeUser(v)
+		if u == nil {
+			return errors.New("unlikely deserialization error")
+		}
+		if u.Uuid == userUuid {
+			root = u
+		}
+		// placeholders of pending invitations have no password yet
+		if u.InvitedBy != "" && u.EncryptedPassword != "" {
+			invited[u.InvitedBy] = append(invited[u.InvitedBy], u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, errors.New("no user")
+	}
+	seen := map[string]bool{}
+	var grow func(u *User) *InviteNode
+	grow = func(u *User) *InviteNode {
+		seen[u.Uuid] = true
+		t := &InviteNode{User: u, Invited: []*InviteNode{}}
+		for _, child := range invited[u.Uuid] {
+			if !seen[child.Uuid] {
+				t.Invited = append(t.Invited, grow(child))
+			}
+		}
+		return t
+	}
+	return grow(root), nil
+}
+
+// InvitationTree returns the user with userUuid and everyone they
+// transitively invited.
+func (a *Authenticator) InvitationTree(userUuid string) (tree *InviteNode, err error) {
+	err = a.db.View(func(tx *bolt.Tx) error {
+		tree, err = a.invitationTree(tx, userUuid)
+		return err
+	})
+	return tree, err
+}
+
+func InvitationTree(userUuid string) (*InviteNode, error) {
+	return defaultAuth.InvitationTree(userUuid)
+}
+
+// RevokeSubtree deactivates a user and, with cascade, everyone they
+// transitively invited. The revoked users are logged out everywhere and
+// their pending invitations are revoked too. It returns the Uuids of the
+// users it deactivated, already inactive ones excluded.
+func (a *Authenticator) RevokeSubtree(userUuid string, cascade bool) ([]string, error) {
+	var revoked []string
+	creators := make(map[string]bool)
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		tree, err := a.invitationTree(tx, userUuid)
+		if err != nil {
+			return err
+		}
+		users := []*User{tree.User}
+		if cascade {
+			users = tree.Users()
+		}
+		sessions := tx.Bucket([]byte("sessions"))
+		for _, u := range users {
+			creators[u.Uuid] = true
+			if sessions.Bucket([]byte(u.Uuid)) != nil {
+				err = sessions.DeleteBucket([]byte(u.Uuid))
+				if err != nil {
+					return err
+				}
+			}
+			if !u.Active {
+				continue
+			}
+			u.Active = false
+			u.Generation++
+			err = putUser(tx, u)
+			if err != nil {
+				return err
+			}
+			revoked = append(revoked, u.Uuid)
+		}
+		var pending []*Invitation
+		err = tx.Bucket([]byte("invitations")).ForEach(func(k, v []byte) error {
+			inv, err := decodeInvitation(v)
+			if err != nil {
+				return err
+			}
+			if inv.Status == InvitationPending && creators[inv.Creator] {
+				pending = append(pending, inv)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, inv := range pending {
+			err = a.closeInvitation(tx, inv, InvitationRevoked)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for uuid := range creators {
+		a.authz.forget(uuid)
+	}
+	return revoked, nil
+}
+
+func RevokeSubtree(userUuid string, cascade bool) ([]string, error) {
+	return defaultAuth.RevokeSubtree(userUuid, cascade)
+}
@@ -1,57 +1,93 @@
 package auth
 
 import (
-	"code.google.com/p/go.crypto/bcrypt"
-	"encoding/json"
 	seq "github.com/streadway/simpleuuid"
 	"net/http"
 	"time"
 )
 
 type User struct {
-	EncryptedPassword string                 `json:-`
-	Uuid              string                 `json:uuid`
-	UniqueName        string                 `json:name`
-	Email             string                 `json:-`
-	Admin             bool                   `json:adm`
-	Trust             int                    `json:trust`
-	Active            bool                   `json:-`
-	LastSeen          time.Time              `json:-`
-	Meta              map[string]interface{} `json:-`
+	EncryptedPassword string                 `json:"-"`
+	Uuid              string                 `json:"uuid"`
+	UniqueName        string                 `json:"name"`
+	Email             string                 `json:"-"`
+	Admin             bool                   `json:"adm"`
+	Trust             int                    `json:"trust"`
+	Active            bool                   `json:"-"`
+	LastSeen          time.Time              `json:"-"`
+	Meta              map[string]interface{} `json:"-"`
+	// Groups are named sets of users for rules to require, see AddToGroup.
+	Groups []string `json:"groups"`
+	// Generation is bumped by Save whenever Admin, Trust, Active or Groups
+	// change, sessions issued in an earlier generation stop working.
+	Generation int `json:"-"`
+	// Two factor login, see EnrollTOTP. The secrets are encrypted with a
+	// key of their own, recovery codes are hashed.
+	TOTPSecret    string   `json:"-"`
+	TOTPPending   string   `json:"-"`
+	TOTPLastStep  int64    `json:"-"`
+	RecoveryCodes []string `json:"-"`
+	// InvitationId is the invitation the account was created from, and
+	// InvitedBy the Uuid of the user who issued it, if any.
+	InvitationId string `json:"-"`
+	InvitedBy    string `json:"-"`
+	// InviteQuota overrides Opts.InviteQuota for DelegateInvitation.
+	InviteQuota int `json:"-"`
+
+	a *Authenticator
 }
 
+// authenticator is the realm the user was created in or loaded from,
+// falling back on the package default.
+func (u *User) authenticator() *Authenticator {
+	if u.a != nil {
+		return u.a
+	}
+	return defaultAuth
+}
+
+// Cookie starts a new session for u and returns the cookie carrying it.
 func (u *User) Cookie() (*http.Cookie, error) {
-	encoded, err := encode(u)
+	return u.cookie(nil, false)
+}
+
+// cookie starts a session, secondFactor records that it was established
+// with a TOTP or recovery code as well as a password.
+func (u *User) cookie(r *http.Request, secondFactor bool) (*http.Cookie, error) {
+	a := u.authenticator()
+	s, err := a.createSession(u, secondFactor)
 	if err != nil {
 		return nil, err
 	}
-	cookie := &http.Cookie{
-		Name:     cookieName,
-		Value:    encoded,
-		Path:     "/",
-		HttpOnly: true,
+	claims, err := newSessionClaims(u, s)
+	if err != nil {
+		return nil, err
 	}
-	return cookie, nil
-}
-
-func getSession(r *http.Request) (u User) {
-	cookie, err := r.Cookie(cookieName)
+	encoded, err := a.encode(claims)
 	if err != nil {
-		return u
+		return nil, err
 	}
-	msg := decode(cookie.Value)
-	if msg == nil {
+	return a.newCookie(encoded, r), nil
+}
+
+// getSession resolves the user behind the request's session cookie, API
+// token or the Basic credentials Wrap admitted it with, the zero User if
+// there isn't a valid one. Tokens with capped trust don't count, handlers
+// would act with the whole user's rights.
+func (a *Authenticator) getSession(r *http.Request) (u User) {
+	c := a.currentClaims(r)
+	if c == nil || c.capped {
 		return u
 	}
-	err = json.Unmarshal(msg, &u)
-	if err != nil {
+	stored, err := (&User{Uuid: c.UserUuid, a: a}).Load()
+	if err != nil || stored == nil {
 		return u
 	}
-	return u
+	return *stored
 }
 
-func (u *User) setSession(w http.ResponseWriter) (err error) {
-	cookie, err := u.Cookie()
+func (u *User) setSession(w http.ResponseWriter, r *http.Request, secondFactor bool) (err error) {
+	cookie, err := u.cookie(r, secondFactor)
 	if err != nil {
 		return
 	}
@@ -60,17 +96,16 @@ func (u *User) setSession(w http.ResponseWriter) (err error) {
 }
 
 func (u *User) OverwriteSession(w http.ResponseWriter) error {
-	http.SetCookie(w, &http.Cookie{
-		Name:     cookieName,
-		Value:    "thanks_for_visiting",
-		Path:     "/",
-		HttpOnly: true,
-	})
+	u.authenticator().clearCookie(w, nil)
 	return nil
 }
 
 func NewUser(email, password string, admin bool, trust int) (u *User, err error) {
-	u = &User{Admin: admin, Trust: trust, Email: email}
+	return defaultAuth.NewUser(email, password, admin, trust)
+}
+
+func (a *Authenticator) NewUser(email, password string, admin bool, trust int) (u *User, err error) {
+	u = &User{Admin: admin, Trust: trust, Email: email, Active: true, a: a}
 	uid, err := seqUid()
 	if err != nil {
 		return nil, err
@@ -80,13 +115,13 @@ func NewUser(email, password string, admin bool, trust int) (u *User, err error)
 	return
 }
 
+// CreatePasswordHash hashes pw with the realm's PasswordHasher and pepper.
 func (u *User) CreatePasswordHash(pw string) (err error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pw), 10)
+	hash, err := u.authenticator().hashPassword(pw)
 	if err != nil {
 		return
 	}
-	u.EncryptedPassword = string(hash)
-	err = nil
+	u.EncryptedPassword = hash
 	return
 }
 
@@ -7,17 +7,19 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"path"
+	"time"
 )
 
-var db *bolt.DB
+const dbLockTimeout = 5 * time.Second
 
-func initDb() error {
+func (a *Authenticator) initDb() error {
 	var err error
-	db, err = bolt.Open(path.Join(dataDir, dbName), 0644, nil)
+	// bolt locks the file, rather than wait on a running server give up
+	a.db, err = bolt.Open(path.Join(a.dataDir, a.dbName), 0644, &bolt.Options{Timeout: dbLockTimeout})
 	if err != nil {
 		return errors.New("unable to access user db")
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = a.db.Update(func(tx *bolt.Tx) error {
 		var err error
 		_, err = tx.CreateBucketIfNotExists([]byte("users"))
 		if err != nil {
@@ -27,11 +29,99 @@ func initDb() error {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("login-failures"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("password-resets"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("invitations"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("api-tokens"))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		err = a.migrateActive(tx)
+		if err != nil {
+			return err
+		}
+		return a.migrateInvitations(tx)
+	})
+	if err != nil {
 		return err
+	}
+	return nil
+}
+
+// Users created before Active was enforced were all saved inactive, the
+// ones that have a password are turned on once.
+func (a *Authenticator) migrateActive(tx *bolt.Tx) error {
+	meta := tx.Bucket([]byte("meta"))
+	if meta.Get([]byte("active-migrated")) != nil {
+		return nil
+	}
+	err := a.rewriteUsers(tx, func(u *User) bool {
+		if !u.Active && u.EncryptedPassword != "" {
+			u.Active = true
+			return true
+		}
+		return false
 	})
 	if err != nil {
 		return err
 	}
+	return meta.Put([]byte("active-migrated"), []byte("1"))
+}
+
+// rewriteUsers saves every user that change reports having changed, keeping
+// both the users and user-name buckets up to date.
+func (a *Authenticator) rewriteUsers(tx *bolt.Tx, change func(u *User) bool) error {
+	var changed []*User
+	err := tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+		u := a.deserializeUser(v)
+		if u != nil && change(u) {
+			changed = append(changed, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, u := range changed {
+		err = putUser(tx, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putUser is Save for use inside a transaction, it doesn't bump the
+// security generation.
+func putUser(tx *bolt.Tx, u *User) error {
+	bits := u.Serialize()
+	if bits == nil {
+		return errors.New("unlikely serialization error")
+	}
+	err := tx.Bucket([]byte("users")).Put([]byte(u.Uuid), bits)
+	if err != nil {
+		return err
+	}
+	if u.UniqueName != "" {
+		return tx.Bucket([]byte("user-name")).Put([]byte(u.UniqueName), bits)
+	}
 	return nil
 }
 
@@ -45,7 +135,7 @@ func (u *User) Serialize() []byte {
 	return buf.Bytes()
 }
 
-func deserializeUser(bits []byte) *User {
+func (a *Authenticator) deserializeUser(bits []byte) *User {
 	var u *User
 	buf := bytes.NewBuffer(bits)
 	dec := gob.NewDecoder(buf)
@@ -54,11 +144,12 @@ func deserializeUser(bits []byte) *User {
 		fmt.Println("deserialize error", err)
 		return nil
 	}
+	u.a = a
 	return u
 }
 
-func dbput(bucket, k string, v []byte) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (a *Authenticator) dbput(bucket, k string, v []byte) error {
+	err := a.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		err := b.Put([]byte(k), []byte(v))
 		if err != nil {
@@ -69,9 +160,9 @@ func dbput(bucket, k string, v []byte) error {
 	return err
 }
 
-func dbget(bucket, k string) []byte {
+func (a *Authenticator) dbget(bucket, k string) []byte {
 	var rv []byte
-	_ = db.View(func(tx *bolt.Tx) error {
+	_ = a.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		rv = b.Get([]byte(k))
 		return nil
@@ -79,21 +170,29 @@ func dbget(bucket, k string) []byte {
 	return rv
 }
 
-func (u *User) Save() (err error) {
-	bits := u.Serialize()
-	if bits == nil {
-		return errors.New("unlikely serialization error")
-	}
-	err = dbput("users", u.Uuid, bits)
+// Save writes both the users and user-name buckets in one transaction, so
+// they can't disagree after a crash.
+func (u *User) Save() error {
+	a := u.authenticator()
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		if prevBits := tx.Bucket([]byte("users")).Get([]byte(u.Uuid)); prevBits != nil {
+			prev := a.deserializeUser(prevBits)
+			if prev == nil {
+				return errors.New("unlikely deserialization error")
+			}
+			if prev.Admin != u.Admin || prev.Trust != u.Trust || prev.Active != u.Active ||
+				!sameGroups(prev.Groups, u.Groups) {
+				u.Generation = prev.Generation + 1
+			} else {
+				u.Generation = prev.Generation
+			}
+		}
+		return putUser(tx, u)
+	})
 	if err != nil {
 		return err
 	}
-	if u.UniqueName != "" {
-		err = dbput("user-name", u.UniqueName, bits)
-		if err != nil {
-			return err
-		}
-	}
+	a.authz.forget(u.Uuid)
 	return nil
 }
 
@@ -101,9 +200,9 @@ func (u *User) ChangeName(newName string) error {
 	if u.UniqueName == "" {
 		return errors.New("nothing to change")
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
+	err := u.authenticator().db.Update(func(tx *bolt.Tx) error {
 		userNameIdx := tx.Bucket([]byte("user-name"))
-		userStore := tx.Bucket([]byte("user-name"))
+		userStore := tx.Bucket([]byte("users"))
 		taken := userNameIdx.Get([]byte(newName))
 		oldName := u.UniqueName
 		if taken != nil {
@@ -135,16 +234,17 @@ func (u *User) Load() (*User, error) {
 	if u.Uuid == "" && u.UniqueName == "" {
 		return nil, errors.New("uninitialized")
 	}
+	a := u.authenticator()
 	var bits []byte
 	var namebits []byte
-	bits = dbget("users", u.Uuid)
-	namebits = dbget("user-name", u.UniqueName)
+	bits = a.dbget("users", u.Uuid)
+	namebits = a.dbget("user-name", u.UniqueName)
 	if bits == nil && namebits == nil {
 		return nil, errors.New("no user")
 	}
 	if bits == nil {
 		bits = namebits
 	}
-	fullUser := deserializeUser(bits)
+	fullUser := a.deserializeUser(bits)
 	return fullUser, nil
 }
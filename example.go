@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"os/user"
 	"strconv"
 )
@@ -15,6 +16,7 @@ import (
 var (
 	firstRun = flag.Bool("first_run", false, "print an initial admin invitation")
 	bind     = flag.String("listen_on", "127.0.0.1:9090", "host:port")
+	site     = flag.String("public_url", "", "where invitation links lead, e.g. https://example.com/admin/")
 )
 
 // Wrappable admin rule:
@@ -24,11 +26,34 @@ var adminRule = &auth.Rule{Admin: true}
 var sharedByInvitation = &auth.Rule{Trust: 5}
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [flags] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, auth.CommandUsage)
+	}
 	flag.Parse()
+	opts := auth.Opts{PublicURL: *site}
+
+	// anything after the flags is a management command, run by the server
+	// if one is up, e.g. `example user list`
+	if flag.NArg() > 0 {
+		err := auth.Command(opts, flag.Args(), os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// initialize with a local db at ~/.config/boring-server/...
-	// use auth.NewWithOpts for non-defaults
-	err := auth.New()
+	// use other auth.Opts for other non-defaults
+	err := auth.NewWithOpts(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	// so that management commands work while we're running
+	err = auth.ListenAdminSocket()
 	if err != nil {
 		panic(err)
 	}
@@ -43,12 +68,40 @@ func main() {
 		} else {
 			username = u.Name
 		}
-		fmt.Println(auth.FirstRunInvitation(username))
+		_, token, err := auth.FirstRunInvitation(username)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			printInvitation(token)
+		}
 	}
 
 	// Usually, we're just a static server
 	http.Handle("/", http.HandlerFunc(generallyPublic))
 
+	// POST or DELETE ends the current session
+	http.Handle("/logout", http.HandlerFunc(auth.Logout))
+
+	// Where password reset links (auth.NewPasswordReset) lead
+	http.Handle("/reset", http.HandlerFunc(auth.ResetPassword))
+
+	// Logged in users mint API tokens here, for scripts to send as
+	// "Authorization: Bearer <token>" to anything behind auth.Wrap
+	http.Handle("/tokens", auth.TokenHandler())
+
+	// Logged in users invite others here, below their own trust and
+	// within their invite quota
+	http.Handle("/invite", auth.InviteHandler())
+
+	// Admins can show pending invitations as QR codes, by ?id=
+	http.Handle("/admin/invitation-qr", auth.InvitationQRHandler())
+
+	// User management in JSON, see auth.AdminAPI
+	http.Handle("/admin/api/", http.StripPrefix("/admin/api", auth.AdminAPI()))
+
+	// And the same in a browser
+	http.Handle("/admin/ui/", auth.AdminUI("/admin/ui"))
+
 	// Viewers of /admin/... have to be admins
 	http.Handle("/admin/", auth.Wrap(http.HandlerFunc(showToAdmins), adminRule))
 
@@ -69,6 +122,21 @@ func main() {
 	http.ListenAndServe(*bind, nil)
 }
 
+// printInvitation shows the invitation as a link and QR code if there's a
+// public url to make them from, or just the token.
+func printInvitation(token string) {
+	link, err := auth.InvitationURL(token)
+	if err != nil {
+		fmt.Println("invitation token (set -public_url for a link):", token)
+		return
+	}
+	fmt.Println(link)
+	code, err := auth.QRCodeText(link)
+	if err == nil {
+		fmt.Print(code)
+	}
+}
+
 func generallyPublic(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "hello")
 	return